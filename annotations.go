@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Annotations reads the annotations of rules for templates. Keys without a `/` are looked up under `Prefix`, e.g.
+// `timeout` stands for `ingressify.omio.com/timeout` with the prefix `ingressify.omio.com`.
+// Values that can't be parsed fail the render rather than silently producing an empty config.
+type Annotations struct {
+	Prefix string
+}
+
+// FuncMap returns the annotation accessors, they all take the rule as last argument so they can be piped
+func (a Annotations) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"hasAnnotation":      a.Has,
+		"annotation":         a.String,
+		"annotationInt":      a.Int,
+		"annotationBool":     a.Bool,
+		"annotationDuration": a.Duration,
+		"annotationList":     a.List,
+		"serviceAnnotation":  a.Service,
+	}
+}
+
+// key returns the full annotation key of `name`
+func (a Annotations) key(name string) string {
+	if a.Prefix == "" || strings.Contains(name, "/") {
+		return name
+	}
+	return strings.TrimSuffix(a.Prefix, "/") + "/" + name
+}
+
+func (a Annotations) lookup(name string, rule IngressifyRule) (string, string, bool) {
+	key := a.key(name)
+	value, ok := rule.Annotations[key]
+	return key, value, ok
+}
+
+func annotationError(key string, value string, rule IngressifyRule, err error) error {
+	return fmt.Errorf("invalid annotation %s=%q on ingress %s/%s: %s", key, value, rule.Namespace, rule.Name, err)
+}
+
+// Has tells whether the rule has the annotation `name`
+func (a Annotations) Has(name string, rule IngressifyRule) bool {
+	_, _, ok := a.lookup(name, rule)
+	return ok
+}
+
+// String returns the annotation `name`, `def` when it is not set
+func (a Annotations) String(name string, def string, rule IngressifyRule) string {
+	if _, value, ok := a.lookup(name, rule); ok {
+		return value
+	}
+	return def
+}
+
+// Int returns the annotation `name` as an integer, `def` when it is not set
+func (a Annotations) Int(name string, def int, rule IngressifyRule) (int, error) {
+	key, value, ok := a.lookup(name, rule)
+	if !ok {
+		return def, nil
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, annotationError(key, value, rule, err)
+	}
+	return i, nil
+}
+
+// Bool returns the annotation `name` as a boolean, `def` when it is not set
+func (a Annotations) Bool(name string, def bool, rule IngressifyRule) (bool, error) {
+	key, value, ok := a.lookup(name, rule)
+	if !ok {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return false, annotationError(key, value, rule, err)
+	}
+	return b, nil
+}
+
+// Duration returns the annotation `name` as a duration, `def` when it is not set.
+// Both Go durations, e.g. `1m30s`, and plain numbers of seconds are accepted.
+func (a Annotations) Duration(name string, def string, rule IngressifyRule) (time.Duration, error) {
+	key, value, ok := a.lookup(name, rule)
+	if !ok {
+		key, value = "default of "+key, def
+	}
+	d, err := parseDuration(strings.TrimSpace(value))
+	if err != nil {
+		return 0, annotationError(key, value, rule, err)
+	}
+	return d, nil
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// List returns the comma separated annotation `name` without blank items, `def` is used when it is not set
+func (a Annotations) List(name string, def string, rule IngressifyRule) []string {
+	_, value, ok := a.lookup(name, rule)
+	if !ok {
+		value = def
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Service returns the annotation `name` of the service of the rule, `def` when it is not set or the service is missing
+func (a Annotations) Service(name string, def string, rule IngressifyRule) string {
+	if rule.Service == nil {
+		return def
+	}
+	if value, ok := rule.Service.Annotations[a.key(name)]; ok {
+		return value
+	}
+	return def
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var annotatedRule = IngressifyRule{Namespace: "ns1", Name: "n1", Annotations: map[string]string{
+	"ingressify.omio.com/timeout":    "1m30s",
+	"ingressify.omio.com/max-conns":  "100",
+	"ingressify.omio.com/sticky":     "true",
+	"ingressify.omio.com/whitelist":  "10.0.0.0/8, ,192.168.0.0/16",
+	"ingressify.omio.com/bad-number": "lots",
+	"other.io/rewrite-target":        "/",
+}}
+
+func TestAnnotationAccessors(t *testing.T) {
+	a := Annotations{Prefix: "ingressify.omio.com"}
+	if v := a.String("other.io/rewrite-target", "", annotatedRule); v != "/" {
+		t.Errorf("Wrong annotation with full key, got: %s, expected: %s", v, "/")
+	}
+	if v := a.String("missing", "default", annotatedRule); v != "default" {
+		t.Errorf("Wrong default annotation, got: %s, expected: %s", v, "default")
+	}
+	if !a.Has("sticky", annotatedRule) || a.Has("missing", annotatedRule) {
+		t.Errorf("Wrong annotation presence")
+	}
+	if v, err := a.Int("max-conns", 0, annotatedRule); err != nil || v != 100 {
+		t.Errorf("Wrong int annotation, got: %d (%v), expected: %d", v, err, 100)
+	}
+	if _, err := a.Int("bad-number", 0, annotatedRule); err == nil {
+		t.Errorf("Invalid int annotation should fail")
+	}
+	if v, err := a.Bool("sticky", false, annotatedRule); err != nil || !v {
+		t.Errorf("Wrong bool annotation, got: %t (%v), expected: %t", v, err, true)
+	}
+	if v, err := a.Duration("timeout", "5s", annotatedRule); err != nil || v != 90*time.Second {
+		t.Errorf("Wrong duration annotation, got: %s (%v), expected: %s", v, err, 90*time.Second)
+	}
+	if v, err := a.Duration("missing", "30", annotatedRule); err != nil || v != 30*time.Second {
+		t.Errorf("Wrong default duration, got: %s (%v), expected: %s", v, err, 30*time.Second)
+	}
+	expected := []string{"10.0.0.0/8", "192.168.0.0/16"}
+	if v := a.List("whitelist", "", annotatedRule); !reflect.DeepEqual(v, expected) {
+		t.Errorf("Wrong list annotation, got: %v, expected: %v", v, expected)
+	}
+	if v := a.List("missing", "", annotatedRule); len(v) != 0 {
+		t.Errorf("Missing list annotation should be empty, got: %v", v)
+	}
+}
+
+func TestAnnotationFuncsFailRender(t *testing.T) {
+	funcs := Annotations{Prefix: "ingressify.omio.com"}.FuncMap()
+	tmpl := template.Must(template.New("test").Funcs(funcs).Parse(`{{ . | annotationInt "max-conns" 10 }}`))
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, annotatedRule); err != nil || out.String() != "100" {
+		t.Errorf("Wrong render, got: %s (%v), expected: %s", out.String(), err, "100")
+	}
+	tmpl = template.Must(template.New("test").Funcs(funcs).Parse(`{{ annotationInt "bad-number" 10 . }}`))
+	if err := tmpl.Execute(&out, annotatedRule); err == nil || !strings.Contains(err.Error(), "ns1/n1") {
+		t.Errorf("Invalid annotation should fail the render naming the ingress, got: %v", err)
+	}
+}
+
+func TestServiceAnnotation(t *testing.T) {
+	a := Annotations{}
+	rule := IngressifyRule{Service: &v1.Service{ObjectMeta: v1.ObjectMeta{
+		Annotations: map[string]string{"haproxy.backend/balance": "leastconn"}}}}
+	if v := a.Service("haproxy.backend/balance", "roundrobin", rule); v != "leastconn" {
+		t.Errorf("Wrong service annotation, got: %s, expected: %s", v, "leastconn")
+	}
+	if v := a.Service("haproxy.backend/balance", "roundrobin", IngressifyRule{ServiceMissing: true}); v != "roundrobin" {
+		t.Errorf("Missing service should use the default, got: %s, expected: %s", v, "roundrobin")
+	}
+}
@@ -1,25 +1,81 @@
 package main
 
 import (
+	"fmt"
 	"github.com/ghodss/yaml"
 	"io/ioutil"
+	"os"
+	"strconv"
 	"time"
 )
 
 // Config represents the structure of the config file
 type Config struct {
-	Kubeconfig      string `json:"kubeconfig"`
-	Interval        string `json:"interval"`
-	InTemplate      string `json:"in_template"`
-	OutTemplate     string `json:"out_file"`
-	HealthCheckPort uint32 `json:"health_check_port"`
-	Hooks           Hook   `json:"hooks"`
+	Kubeconfig        string           `json:"kubeconfig"`
+	Interval          string           `json:"interval"`
+	InTemplate        string           `json:"in_template"`
+	OutTemplate       string           `json:"out_file"`
+	Engine            string           `json:"engine"`
+	HealthCheckPort   uint32           `json:"health_check_port"`
+	IngressAPIVersion string           `json:"ingress_api_version"`
+	ScrapeEndpoints   bool             `json:"scrape_endpoints"`
+	TLSDir            string           `json:"tls_dir"`
+	AnnotationPrefix  string           `json:"annotation_prefix"`
+	NamespacePriority []string         `json:"namespace_priority"`
+	ShutdownGrace     string           `json:"shutdown_grace_period"`
+	Templates         []TemplateConfig `json:"templates"`
+	Hooks             Hook             `json:"hooks"`
+	Scope
+}
+
+// TemplateConfig is a template along with where and how its output is written.
+// Only the validate and post-render hooks are used.
+type TemplateConfig struct {
+	InTemplate  string `json:"in_template"`
+	OutTemplate string `json:"out_file"`
+	Engine      string `json:"engine"`
+	Mode        string `json:"mode"`
+	Hooks       Hook   `json:"hooks"`
+}
+
+// getTemplates returns all the templates to render, `in_template` first when set along with the global validate hook
+func (c Config) getTemplates() []TemplateConfig {
+	var templates []TemplateConfig
+	if c.InTemplate != "" {
+		templates = append(templates, TemplateConfig{
+			InTemplate:  c.InTemplate,
+			OutTemplate: c.OutTemplate,
+			Engine:      c.Engine,
+			Hooks:       Hook{Validate: c.Hooks.Validate},
+		})
+	}
+	return append(templates, c.Templates...)
+}
+
+// getMode parses the octal file mode of the output, 0 means keeping the current mode
+func (t TemplateConfig) getMode() (os.FileMode, error) {
+	if t.Mode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(t.Mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode %q for %s: %s", t.Mode, t.OutTemplate, err)
+	}
+	return os.FileMode(mode), nil
 }
 
 func (c Config) getInterval() (time.Duration, error) {
 	return time.ParseDuration(c.Interval)
 }
 
+// getGracePeriod returns how long the running cycle is given to finish on shutdown, SHUTDOWNGRACEPERIOD by default
+func (c Config) getGracePeriod() (time.Duration, error) {
+	if c.ShutdownGrace == "" {
+		return SHUTDOWNGRACEPERIOD, nil
+	}
+	return time.ParseDuration(c.ShutdownGrace)
+}
+
 // ReadConfig is a helper function to read the config
 func ReadConfig(path string) Config {
 	var config Config
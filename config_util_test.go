@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGetTemplatesPutsInTemplateFirst(t *testing.T) {
+	config := Config{
+		InTemplate:  "main.tmpl",
+		OutTemplate: "main.cfg",
+		Hooks:       Hook{Validate: HookSteps{{Command: []string{"check", "{{file}}"}}}},
+		Templates:   []TemplateConfig{{InTemplate: "map.tmpl", OutTemplate: "map.cfg"}},
+	}
+	templates := config.getTemplates()
+	if len(templates) != 2 {
+		t.Fatalf("Wrong number of templates, got: %d, expected: %d", len(templates), 2)
+	}
+	if templates[0].InTemplate != "main.tmpl" || len(templates[0].Hooks.Validate) != 1 {
+		t.Errorf("in_template should come first with the global validate hook, got: %+v", templates[0])
+	}
+	if templates[1].InTemplate != "map.tmpl" || len(templates[1].Hooks.Validate) != 0 {
+		t.Errorf("Global validate hook should not apply to other templates, got: %+v", templates[1])
+	}
+	if templates = (Config{Templates: config.Templates}).getTemplates(); len(templates) != 1 {
+		t.Errorf("Only templates should be rendered without in_template, got: %d", len(templates))
+	}
+}
+
+func TestGetMode(t *testing.T) {
+	if mode, err := (TemplateConfig{Mode: "0640"}).getMode(); err != nil || mode != os.FileMode(0640) {
+		t.Errorf("Wrong mode, got: %s (%v), expected: %s", mode, err, os.FileMode(0640))
+	}
+	if mode, err := (TemplateConfig{}).getMode(); err != nil || mode != 0 {
+		t.Errorf("Empty mode should be 0, got: %s (%v)", mode, err)
+	}
+	if _, err := (TemplateConfig{Mode: "rw-r--r--"}).getMode(); err == nil {
+		t.Errorf("Invalid mode should be rejected")
+	}
+}
+
+func TestGetGracePeriod(t *testing.T) {
+	if grace, err := (Config{}).getGracePeriod(); err != nil || grace != SHUTDOWNGRACEPERIOD {
+		t.Errorf("Wrong default grace period, got: %s (%v), expected: %s", grace, err, SHUTDOWNGRACEPERIOD)
+	}
+	if grace, err := (Config{ShutdownGrace: "5s"}).getGracePeriod(); err != nil || grace != 5*time.Second {
+		t.Errorf("Wrong grace period, got: %s (%v), expected: %s", grace, err, 5*time.Second)
+	}
+	if _, err := (Config{ShutdownGrace: "later"}).getGracePeriod(); err == nil {
+		t.Errorf("Invalid grace period should be rejected")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/apex/log"
+)
+
+// Conflict is a rule dropped because another ingress claims the same host and path, whatever their path types
+type Conflict struct {
+	Host     string
+	Path     string
+	PathType string
+	Winner   IngressifyRule
+	Loser    IngressifyRule
+}
+
+// routeKey identifies the route claimed by a rule. The path type is left out: rules of different ingresses with the
+// same host and path but different path types would still be rendered as competing routes.
+func routeKey(rule IngressifyRule) string {
+	return rule.Host + "\xff" + rule.Path
+}
+
+func ingressKey(rule IngressifyRule) string {
+	return ServiceKey(rule.Namespace, rule.Name)
+}
+
+// precedes tells whether the ingress of `a` wins over the one of `b`: namespaces listed in `priority` win over later
+// and unlisted ones, then the oldest ingress wins, then the first by namespace/name.
+func precedes(a IngressifyRule, b IngressifyRule, priority map[string]int) bool {
+	pa, pb := rank(a.Namespace, priority), rank(b.Namespace, priority)
+	if pa != pb {
+		return pa < pb
+	}
+	ta, tb := a.IngressRaw.CreationTimestamp.Time, b.IngressRaw.CreationTimestamp.Time
+	if !ta.Equal(tb) {
+		return ta.Before(tb)
+	}
+	return ingressKey(a) < ingressKey(b)
+}
+
+// priorities returns the rank of the namespaces of `namespacePriority`, the first occurrence of a namespace counting
+func priorities(namespacePriority []string) map[string]int {
+	priority := make(map[string]int)
+	for i, ns := range namespacePriority {
+		if _, ok := priority[ns]; !ok {
+			priority[ns] = i
+		}
+	}
+	return priority
+}
+
+func rank(namespace string, priority map[string]int) int {
+	if r, ok := priority[namespace]; ok {
+		return r
+	}
+	return len(priority)
+}
+
+// ResolveConflicts keeps, for every host and path, only the rules of the ingress winning it according to
+// `namespacePriority` (see precedes). Dropped rules are returned as conflicts, the order of the kept rules is preserved.
+func ResolveConflicts(rules []IngressifyRule, namespacePriority []string) ([]IngressifyRule, []Conflict) {
+	priority := priorities(namespacePriority)
+	winners := make(map[string]IngressifyRule)
+	for _, rule := range rules {
+		key := routeKey(rule)
+		if winner, ok := winners[key]; !ok || precedes(rule, winner, priority) {
+			winners[key] = rule
+		}
+	}
+	var kept []IngressifyRule
+	var conflicts []Conflict
+	for _, rule := range rules {
+		winner := winners[routeKey(rule)]
+		if ingressKey(winner) == ingressKey(rule) {
+			kept = append(kept, rule)
+			continue
+		}
+		log.Warnf("Ingress %s claims host %q path %q already claimed by ingress %s, dropping the rule",
+			ingressKey(rule), rule.Host, rule.Path, ingressKey(winner))
+		conflicts = append(conflicts, Conflict{Host: rule.Host, Path: rule.Path, PathType: rule.PathType,
+			Winner: winner, Loser: rule})
+	}
+	return kept, conflicts
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/client-go/pkg/api/unversioned"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+func claimingRule(namespace string, name string, created time.Time, path string) IngressifyRule {
+	raw := v1beta1.Ingress{ObjectMeta: v1.ObjectMeta{Namespace: namespace, Name: name,
+		CreationTimestamp: unversioned.NewTime(created)}}
+	return IngressifyRule{Namespace: namespace, Name: name, Host: "foo.com", Path: path, IngressRaw: raw}
+}
+
+func TestResolveConflicts(t *testing.T) {
+	now := time.Now()
+	rules := []IngressifyRule{
+		claimingRule("team-b", "hijack", now, "/"),
+		claimingRule("team-b", "hijack", now, "/b"),
+		claimingRule("team-a", "site", now.Add(-time.Hour), "/"),
+		claimingRule("team-a", "site", now.Add(-time.Hour), "/a"),
+	}
+
+	kept, conflicts := ResolveConflicts(rules, nil)
+	if len(kept) != 3 || kept[0].Path != "/b" || kept[1].Name != "site" || kept[2].Path != "/a" {
+		t.Errorf("Oldest ingress should win keeping the order, got: %v", kept)
+	}
+	if len(conflicts) != 1 || conflicts[0].Loser.Name != "hijack" || conflicts[0].Winner.Name != "site" || conflicts[0].Path != "/" {
+		t.Errorf("Wrong conflicts, got: %v", conflicts)
+	}
+
+	kept, conflicts = ResolveConflicts(rules, []string{"team-b"})
+	if len(kept) != 3 || kept[0].Name != "hijack" || len(conflicts) != 1 || conflicts[0].Loser.Name != "site" {
+		t.Errorf("Prioritized namespace should win, got: %v %v", kept, conflicts)
+	}
+}
+
+func TestResolveConflictsKeepsRulesOfTheSameIngress(t *testing.T) {
+	now := time.Now()
+	rules := []IngressifyRule{claimingRule("ns1", "n1", now, "/"), claimingRule("ns1", "n1", now, "/")}
+	if kept, conflicts := ResolveConflicts(rules, nil); len(kept) != 2 || len(conflicts) != 0 {
+		t.Errorf("Rules of the same ingress don't conflict, got: %v %v", kept, conflicts)
+	}
+}
+
+func TestResolveConflictsIgnoresPathTypes(t *testing.T) {
+	now := time.Now()
+	prefix := claimingRule("team-a", "site", now.Add(-time.Hour), "/api")
+	prefix.PathType = PATHTYPEPREFIX
+	specific := claimingRule("team-b", "hijack", now, "/api")
+	specific.PathType = PATHTYPEIMPLEMENTATIONSPECIFIC
+
+	kept, conflicts := ResolveConflicts([]IngressifyRule{specific, prefix}, nil)
+	if len(kept) != 1 || kept[0].Name != "site" || kept[0].PathType != PATHTYPEPREFIX {
+		t.Errorf("Only the oldest ingress should keep the path, got: %v", kept)
+	}
+	if len(conflicts) != 1 || conflicts[0].Loser.Name != "hijack" || conflicts[0].PathType != PATHTYPEIMPLEMENTATIONSPECIFIC {
+		t.Errorf("Wrong conflicts, got: %v", conflicts)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+// runCycle executes the pre-render hook, renders all the outputs from the same context, validates them, commits them
+// and executes the post-render hooks, reporting the outcome to `opsStatus`.
+// Outputs are handled as a whole: if one fails validation none is committed, and when a post-render hook fails
+// the previous content of every committed output is restored.
+// Outputs identical to the current ones are neither written nor validated, and their hooks are not run.
+// Certificates are staged along with the outputs and committed right before validation, so that the validate hooks
+// can load them. They are rolled back whenever the outputs are not committed, and when only they changed the global
+// post-render hook is still run.
+// The on-failure hook is run when the cycle fails, the results of the hooks are reported along with the outcome.
+// When `ctx` is cancelled the cycle is aborted, unless the outputs are already committed: it then finishes so that
+// the post-render hooks apply them.
+func runCycle(ctx context.Context, config Config, clientset *kubernetes.Clientset, outputs []Output, cycle Cycle, opsStatus chan *OpsStatus) {
+	var hooks []HookResult
+	err := execPreRenderHook(config, cycle, &hooks)
+	if err != nil {
+		reportFailure(config, cycle, opsStatus, err, hooks)
+		return //the pre-render hook vetoed this cycle
+	}
+	if aborted(ctx, opsStatus, nil, nil, hooks) {
+		return
+	}
+	pendings, certs, cxt, err := render(config, clientset, outputs)
+	if err != nil {
+		log.WithError(err).Error("Failed to render template")
+		reportFailure(config, cycle, opsStatus, err, hooks)
+		return //we don't bother to exec hooks since the rendering failed
+	}
+	cycle.Context = &cxt
+	var changed []*PendingOutput
+	var changedOutputs []Output
+	for i, pending := range pendings {
+		if pending.Changed {
+			changed = append(changed, pending)
+			changedOutputs = append(changedOutputs, outputs[i])
+		} else {
+			pending.Discard()
+		}
+	}
+	if len(changed) == 0 && len(certs) == 0 {
+		log.Info("Rendered outputs are unchanged, skipping commit and hooks")
+		report(opsStatus, &OpsStatus{isSuccess: true, unchanged: true, timestamp: time.Now(), hooks: hooks})
+		return
+	}
+	if aborted(ctx, opsStatus, append(changed, certs...), nil, hooks) {
+		return
+	}
+	err = commitAll(certs)
+	if err != nil {
+		log.WithError(err).Error("Failed to commit certificates")
+		discardAll(changed)
+		reportFailure(config, cycle, opsStatus, err, hooks)
+		return
+	}
+	for i, pending := range changed {
+		err = execValidateHook(config, changedOutputs[i], cycle.ForOutput(pending), pending.TempPath, &hooks)
+		if err != nil {
+			discardAll(changed)
+			reportFailure(config, cycle, opsStatus, restoreCertificates(err, certs), hooks)
+			return //the live outputs are left untouched
+		}
+	}
+	if aborted(ctx, opsStatus, changed, certs, hooks) {
+		return //the validated outputs are not committed
+	}
+	err = commitAll(changed)
+	if err != nil {
+		log.WithError(err).Error("Failed to commit rendered templates")
+		reportFailure(config, cycle, opsStatus, restoreCertificates(err, certs), hooks)
+		return
+	}
+	for i, pending := range changed {
+		err = execHooks(changedOutputs[i].Hooks.PostRender, cycle.ForOutput(pending), &hooks, config.Hooks, changedOutputs[i].Hooks)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		cycle.Changed = true
+		err = execHooks(config.Hooks.PostRender, cycle, &hooks, config.Hooks)
+	}
+	if err != nil {
+		if rerr := rollbackAll(append(changed, certs...)); rerr != nil {
+			err = errors.Wrapf(err, "post-render hook failed and previous outputs could not be restored (%s)", rerr)
+		} else {
+			err = errors.Wrap(err, "post-render hook failed, previous outputs restored")
+		}
+		reportFailure(config, cycle, opsStatus, err, hooks)
+		return
+	}
+	report(opsStatus, &OpsStatus{isSuccess: true, timestamp: time.Now(), hooks: hooks})
+}
+
+// aborted tells whether the cycle must be aborted because `ctx` was cancelled, it then discards `pendings`, rolls
+// back the `committed` certificates and reports the aborted cycle
+func aborted(ctx context.Context, opsStatus chan *OpsStatus, pendings []*PendingOutput, committed []*PendingOutput, hooks []HookResult) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	log.Warn("Shutting down, aborting render cycle")
+	discardAll(pendings)
+	err := restoreCertificates(errors.New("render cycle aborted on shutdown"), committed)
+	report(opsStatus, &OpsStatus{isSuccess: false, timestamp: time.Now(), error: err, hooks: hooks})
+	return true
+}
+
+// restoreCertificates rolls back the committed `certs` of a cycle failing with `err`, returning the error to report
+func restoreCertificates(err error, certs []*PendingOutput) error {
+	if rerr := rollbackAll(certs); rerr != nil {
+		return errors.Wrapf(err, "previous certificates could not be restored (%s)", rerr)
+	}
+	return err
+}
+
+// reportFailure runs the on-failure hook and reports the failed cycle
+func reportFailure(config Config, cycle Cycle, opsStatus chan *OpsStatus, err error, hooks []HookResult) {
+	execFailureHook(config, cycle, err, &hooks)
+	report(opsStatus, &OpsStatus{isSuccess: false, timestamp: time.Now(), error: err, hooks: hooks})
+}
+
+// report records the outcome of a cycle in the metrics and bubbles it up to the health check.
+// It never blocks the cycles: when the health check is behind, the oldest pending report is dropped.
+func report(opsStatus chan *OpsStatus, status *OpsStatus) {
+	metrics.ObserveCycle(status)
+	for {
+		select {
+		case opsStatus <- status:
+			return
+		default:
+		}
+		select {
+		case <-opsStatus:
+		default:
+		}
+	}
+}
+
+func outFiles(outputs []Output) []string {
+	var files []string
+	for _, output := range outputs {
+		files = append(files, output.OutTemplate)
+	}
+	return files
+}
+
+func discardAll(pendings []*PendingOutput) {
+	for _, pending := range pendings {
+		pending.Discard()
+	}
+}
+
+// commitAll commits all `pendings`, when one fails the already committed ones are rolled back
+func commitAll(pendings []*PendingOutput) error {
+	for i, pending := range pendings {
+		if err := pending.Commit(); err != nil {
+			discardAll(pendings[i+1:])
+			if rerr := rollbackAll(pendings[:i]); rerr != nil {
+				return errors.Wrapf(err, "previous outputs could not be restored (%s)", rerr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackAll restores the previous content of all `pendings`, returning the last error
+func rollbackAll(pendings []*PendingOutput) error {
+	var err error
+	for _, pending := range pendings {
+		if rerr := pending.Rollback(); rerr != nil {
+			log.WithError(rerr).Errorf("Failed to restore previous content of %s", pending.OutPath)
+			err = rerr
+		}
+	}
+	return err
+}
+
+// runHook runs the steps of `hook` with the timeout and environment of `hooks`, the later ones taking precedence,
+// and appends their results to `results`
+func runHook(name string, hook HookSteps, cycle Cycle, results *[]HookResult, hooks ...Hook) error {
+	if len(hook) == 0 {
+		return nil
+	}
+	opts, err := hookOptions(cycle, hooks...)
+	if err != nil {
+		return err
+	}
+	res, err := RunSteps(name, hook, opts)
+	*results = append(*results, res...)
+	return err
+}
+
+func execPreRenderHook(config Config, cycle Cycle, results *[]HookResult) error {
+	if len(config.Hooks.PreRender) == 0 {
+		return nil
+	}
+	log.Info("Running pre hook")
+	err := runHook("pre_render", config.Hooks.PreRender, cycle, results, config.Hooks)
+	if err != nil {
+		log.WithError(err).Error("Failed to run pre hook, skipping render")
+		return errors.Wrap(err, "pre-render hook failed")
+	}
+	return nil
+}
+
+func execValidateHook(config Config, output Output, cycle Cycle, file string, results *[]HookResult) error {
+	if len(output.Hooks.Validate) == 0 {
+		return nil
+	}
+	log.Infof("Running validate hook for %s", cycle.OutFile)
+	err := runHook("validate", output.Hooks.Validate.WithFile(file), cycle, results, config.Hooks, output.Hooks)
+	if err != nil {
+		log.WithError(err).Errorf("Rendered template for %s failed validation, keeping previous outputs", cycle.OutFile)
+		return errors.Wrapf(err, "validate hook failed for %s", cycle.OutFile)
+	}
+	return nil
+}
+
+func execHooks(hook HookSteps, cycle Cycle, results *[]HookResult, hooks ...Hook) error {
+	if len(hook) == 0 {
+		return nil
+	}
+	log.Info("Running post hook")
+	err := runHook("post_render", hook, cycle, results, hooks...)
+	if err != nil {
+		log.WithError(err).Error("Failed to run post hook")
+		return err
+	}
+	return nil
+}
+
+// execFailureHook runs the on-failure hook with the reason of the failure, its own failure is only logged
+func execFailureHook(config Config, cycle Cycle, cause error, results *[]HookResult) {
+	if len(config.Hooks.OnFailure) == 0 {
+		return
+	}
+	log.Info("Running on failure hook")
+	cycle.Error = cause.Error()
+	if err := runHook("on_failure", config.Hooks.OnFailure, cycle, results, config.Hooks); err != nil {
+		log.WithError(err).Error("Failed to run on failure hook")
+	}
+}
+
+// scrapeIngresses retrieves the ingresses in the scope of the config with the configured API version,
+// and the class and path types of networking.k8s.io/v1 ingresses
+func scrapeIngresses(config Config, clientset kubernetes.Interface) (*v1beta1.IngressList, Converted, error) {
+	inScope, err := config.Scope.NamespaceFilter(clientset)
+	if err != nil {
+		return nil, nil, err
+	}
+	irules := &v1beta1.IngressList{}
+	converted := make(Converted)
+	for _, namespace := range config.Scope.scrapedNamespaces() {
+		var list *v1beta1.IngressList
+		if config.IngressAPIVersion == NETWORKINGV1 {
+			var aside Converted
+			list, aside, err = ScrapeNetworkingIngresses(clientset, namespace, config.Scope.IngressSelector)
+			for key, extra := range aside {
+				converted[key] = extra
+			}
+		} else {
+			list, err = ScrapeIngressesMatching(clientset, namespace, config.Scope.IngressSelector)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		irules.Items = append(irules.Items, list.Items...)
+	}
+	irules = FilterIngresses(irules, inScope)
+	if !config.Scope.usesClasses() {
+		return irules, converted, nil
+	}
+	var classes []NetworkingIngressClass
+	if config.Scope.needsClasses(irules, converted) {
+		classes, err = ScrapeIngressClasses(clientset)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return FilterIngressClass(irules, converted, config.Scope.ClassFilter(classes)), converted, nil
+}
+
+// watchChanges watches everything that affects the rendered outputs and signals `events` on changes
+func watchChanges(config Config, clientset kubernetes.Interface, events chan<- struct{}, stop <-chan struct{}) {
+	for _, namespace := range config.Scope.scrapedNamespaces() {
+		if config.IngressAPIVersion == NETWORKINGV1 {
+			go WatchNetworkingIngresses(clientset, namespace, config.Scope.IngressSelector, events, stop)
+		} else {
+			go WatchIngresses(clientset, namespace, config.Scope.IngressSelector, events, stop)
+		}
+		go WatchServices(clientset, namespace, events, stop)
+		if config.ScrapeEndpoints {
+			go WatchEndpoints(clientset, namespace, events, stop)
+		}
+		if config.TLSDir != "" {
+			go WatchSecrets(clientset, namespace, events, stop)
+		}
+	}
+	if config.Scope.usesClasses() {
+		go WatchIngressClasses(clientset, events, stop)
+	}
+	if config.Scope.NamespaceSelector != "" {
+		go WatchNamespaces(clientset, config.Scope.NamespaceSelector, events, stop)
+	}
+}
+
+// buildContext scrapes k8s and builds the context shared by all the templates of a cycle.
+// It also stages the changes of the certificates of `tls_dir`.
+func buildContext(config Config, clientset *kubernetes.Clientset) (ICxt, []*PendingOutput, error) {
+	irules, converted, err := scrapeIngresses(config, clientset)
+	if err != nil {
+		return ICxt{}, nil, err
+	}
+	cxt := ICxt{DefaultBackends: ToDefaultBackends(irules, converted)}
+	cxt.IngRules, cxt.Conflicts = ResolveConflicts(ToIngressifyRuleConverted(irules, converted), config.NamespacePriority)
+	metrics.ObserveConflicts(cxt.Conflicts)
+	ingresses := make(map[string]int)
+	for _, ing := range irules.Items {
+		ingresses[ing.Namespace]++
+	}
+	metrics.ObserveScrape(ingresses, cxt.IngRules)
+	backends := append(append([]IngressifyRule{}, cxt.IngRules...), cxt.DefaultBackends...)
+	referencedServices.SetServices(backends)
+	services, unlisted, err := ScrapeServices(clientset, backends)
+	if err != nil {
+		return ICxt{}, nil, err
+	}
+	cxt.Services = services
+	// rules whose service doesn't exist are not rendered, templates only get them in .MissingServices
+	var missingRules, missingBackends []IngressifyRule
+	cxt.IngRules, missingRules = WithoutMissingServices(WithServices(cxt.IngRules, services, unlisted))
+	cxt.DefaultBackends, missingBackends = WithoutMissingServices(WithServices(cxt.DefaultBackends, services, unlisted))
+	cxt.MissingServices = append(missingRules, missingBackends...)
+	if config.ScrapeEndpoints {
+		endpoints, err := ScrapeEndpoints(clientset, backends)
+		if err != nil {
+			return ICxt{}, nil, err
+		}
+		cxt.IngRules = WithEndpoints(cxt.IngRules, services, endpoints)
+		cxt.DefaultBackends = WithEndpoints(cxt.DefaultBackends, services, endpoints)
+		cxt.Endpoints = GroupEndpoints(endpoints)
+	}
+	var certs []*PendingOutput
+	if config.TLSDir != "" {
+		secrets := ScrapeSecrets(clientset, cxt.IngRules)
+		cxt.Certificates, certs, err = StageCertificates(config.TLSDir, cxt.IngRules, secrets, config.NamespacePriority)
+		if err != nil {
+			return ICxt{}, nil, err
+		}
+		cxt.IngRules = WithCertificates(cxt.IngRules, cxt.Certificates)
+	}
+	return cxt, certs, nil
+}
+
+// render renders every output from the same context, either all outputs are rendered or none.
+// It also returns the staged certificates and the context.
+func render(config Config, clientset *kubernetes.Clientset, outputs []Output) ([]*PendingOutput, []*PendingOutput, ICxt, error) {
+	start := time.Now()
+	defer func() { metrics.RenderDuration.Observe(time.Since(start).Seconds()) }()
+	cxt, certs, err := buildContext(config, clientset)
+	if err != nil {
+		metrics.RenderFailures.Add(1)
+		return nil, nil, ICxt{}, err
+	}
+	var pendings []*PendingOutput
+	for _, output := range outputs {
+		pending, err := RenderPending(output.Tmpl, output.OutTemplate, cxt)
+		if err != nil {
+			metrics.RenderFailures.Add(1)
+			discardAll(pendings)
+			discardAll(certs)
+			return nil, nil, ICxt{}, err
+		}
+		pending.SetMode(output.Mode)
+		pendings = append(pendings, pending)
+	}
+	return pendings, certs, cxt, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+)
+
+func TestCommitAllRollsBackOnFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingressify")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	outpath := filepath.Join(dir, "main.cfg")
+	if err = ioutil.WriteFile(outpath, []byte("previous"), 0644); err != nil {
+		t.Fatalf("Failed to write output: %s", err)
+	}
+	pending, err := RenderPending(template.Must(template.New("test").Parse("rendered")), outpath, ICxt{})
+	if err != nil {
+		t.Fatalf("Failed to render: %s", err)
+	}
+	broken := &PendingOutput{OutPath: filepath.Join(dir, "map.cfg"), TempPath: filepath.Join(dir, "missing")}
+
+	if err = commitAll([]*PendingOutput{pending, broken}); err == nil {
+		t.Errorf("Commit should fail when an output can't be committed")
+	}
+	if content, _ := ioutil.ReadFile(outpath); string(content) != "previous" {
+		t.Errorf("Committed outputs should be rolled back, got: %s", content)
+	}
+}
+
+func TestOutFiles(t *testing.T) {
+	outputs := []Output{
+		{TemplateConfig: TemplateConfig{OutTemplate: "main.cfg"}},
+		{TemplateConfig: TemplateConfig{OutTemplate: "map.cfg"}},
+	}
+	if files := outFiles(outputs); len(files) != 2 || files[0] != "main.cfg" || files[1] != "map.cfg" {
+		t.Errorf("Wrong output files, got: %v", files)
+	}
+}
+
+func TestAbortedDiscardsPendings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingressify")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	pending, err := RenderPending(template.Must(template.New("test").Parse("rendered")), filepath.Join(dir, "main.cfg"), ICxt{})
+	if err != nil {
+		t.Fatalf("Failed to render: %s", err)
+	}
+	opsStatus := make(chan *OpsStatus, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	if aborted(ctx, opsStatus, []*PendingOutput{pending}, nil, nil) {
+		t.Fatalf("Cycle should go on until the context is cancelled")
+	}
+	cancel()
+	if !aborted(ctx, opsStatus, []*PendingOutput{pending}, nil, nil) {
+		t.Fatalf("Cycle should be aborted once the context is cancelled")
+	}
+	if status := <-opsStatus; status.isSuccess || status.error == nil {
+		t.Errorf("Aborted cycle should be reported as failed, got: %+v", status)
+	}
+	if _, err = os.Stat(pending.TempPath); !os.IsNotExist(err) {
+		t.Errorf("Pending output should be discarded, got: %v", err)
+	}
+	if _, err = os.Stat(pending.OutPath); !os.IsNotExist(err) {
+		t.Errorf("Output should not be written, got: %v", err)
+	}
+}
+
+func TestAbortedRestoresCommittedCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingressify")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "foo.com.pem")
+	if err = ioutil.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %s", err)
+	}
+	cert, err := stageCertificate(path, []byte("new"))
+	if err != nil {
+		t.Fatalf("Failed to stage certificate: %s", err)
+	}
+	if err = commitAll([]*PendingOutput{cert}); err != nil {
+		t.Fatalf("Failed to commit certificate: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if !aborted(ctx, make(chan *OpsStatus, 1), nil, []*PendingOutput{cert}, nil) {
+		t.Fatalf("Cycle should be aborted once the context is cancelled")
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "old" {
+		t.Errorf("Committed certificate should be restored, got: %s", content)
+	}
+}
@@ -1,30 +1,71 @@
 package main
 
 import (
+	"fmt"
 	"hash/fnv"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/apex/log"
 	tb "github.com/viant/toolbox"
+	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/pkg/util/intstr"
 )
 
 // IngressifyRule is a denormalization of the Ingresses rules coming from k8s
 type IngressifyRule struct {
-	Hash        uint32
-	ServiceName string
-	ServicePort int32
-	Host        string
-	Path        string
-	Namespace   string
-	Name        string
-	IngressRaw  v1beta1.Ingress
+	Hash            uint32
+	ServiceName     string
+	ServicePort     int32
+	ServicePortName string
+	TargetPort      int32
+	TargetPortName  string
+	Host            string
+	Path            string
+	PathType        string
+	IngressClass    string
+	TLS             bool
+	TLSSecret       string
+	TLSCertFile     string
+	DefaultBackend  bool
+	Annotations     map[string]string
+	Labels          map[string]string
+	Error           string
+	Service         *v1.Service
+	ServiceMissing  bool
+	Namespace       string
+	Name            string
+	Endpoints       []Endpoint
+	IngressRaw      v1beta1.Ingress
+}
+
+// Endpoint is the address of a pod backing a service port
+type Endpoint struct {
+	IP       string
+	Hostname string
+	PodName  string
+	Port     int32
+	PortName string
+	Ready    bool
 }
 
 // ICxt holds data used for rendering.
 type ICxt struct {
-	IngRules []IngressifyRule
+	IngRules        []IngressifyRule
+	DefaultBackends []IngressifyRule
+	Conflicts       []Conflict
+	MissingServices []IngressifyRule
+	Services        map[string]v1.Service
+	Endpoints       map[string][]Endpoint
+	Certificates    map[string]string
+}
+
+// ServiceKey returns the key used to index services and endpoints: namespace/name
+func ServiceKey(namespace string, name string) string {
+	return namespace + "/" + name
 }
 
 func hash(s string) uint32 {
@@ -45,24 +86,214 @@ func AsSlice(sourceSlice interface{}) []interface{} {
 
 // ToIngressifyRule converts from *v1beta1.IngressList (normalized) to IngressifyRule (denormalized)
 func ToIngressifyRule(il *v1beta1.IngressList) []IngressifyRule {
+	return ToIngressifyRuleConverted(il, nil)
+}
+
+// ToIngressifyRuleConverted converts like ToIngressifyRule, taking the class and the path types of converted
+// networking.k8s.io/v1 ingresses from `converted`
+func ToIngressifyRuleConverted(il *v1beta1.IngressList, converted Converted) []IngressifyRule {
 	var ifyrules []IngressifyRule
 	for _, ing := range il.Items {
 		var ir IngressifyRule
 		ir.Namespace = ing.Namespace
 		ir.Name = ing.Name
-		for _, rule := range ing.Spec.Rules {
+		ir.IngressClass = converted.Class(ing)
+		ir.Annotations = ing.Annotations
+		ir.Labels = ing.Labels
+		ir.IngressRaw = ing
+		for i, rule := range ing.Spec.Rules {
 			ir.Host = rule.Host
-			for _, path := range rule.HTTP.Paths {
+			ir.TLSSecret, ir.TLS = tlsSecret(ing, rule.Host)
+			if rule.HTTP == nil {
+				// a rule without paths sends all the traffic of its host to the default backend
+				if ing.Spec.Backend != nil && rule.Host != "" {
+					ir.Path = ""
+					ir.PathType = PATHTYPEIMPLEMENTATIONSPECIFIC
+					dr := withBackend(ir, *ing.Spec.Backend)
+					dr.DefaultBackend = true
+					ifyrules = append(ifyrules, dr)
+				}
+				continue
+			}
+			for j, path := range rule.HTTP.Paths {
 				ir.Path = path.Path
-				ir.ServiceName = path.Backend.ServiceName
-				ir.ServicePort = path.Backend.ServicePort.IntVal
-				ir.Hash = hash(ing.Namespace + ing.Name + path.Backend.ServiceName + ir.Host + ir.Path)
-				ir.IngressRaw = ing
-				ifyrules = append(ifyrules, ir)
+				ir.PathType = converted.PathType(ing, i, j)
+				ifyrules = append(ifyrules, withBackend(ir, path.Backend))
 			}
 		}
 	}
-	return ifyrules
+	return sortRules(ifyrules)
+}
+
+// ToDefaultBackends returns the default backend of every ingress of `il` that has one, as a rule without host and path.
+// The class of converted networking.k8s.io/v1 ingresses is taken from `converted`.
+func ToDefaultBackends(il *v1beta1.IngressList, converted Converted) []IngressifyRule {
+	var backends []IngressifyRule
+	for _, ing := range il.Items {
+		if ing.Spec.Backend == nil {
+			continue
+		}
+		ir := IngressifyRule{Namespace: ing.Namespace, Name: ing.Name, IngressRaw: ing, DefaultBackend: true,
+			IngressClass: converted.Class(ing), PathType: PATHTYPEIMPLEMENTATIONSPECIFIC,
+			Annotations: ing.Annotations, Labels: ing.Labels}
+		backends = append(backends, withBackend(ir, *ing.Spec.Backend))
+	}
+	return sortRules(backends)
+}
+
+// withBackend returns a copy of `ir` pointing to `backend`
+func withBackend(ir IngressifyRule, backend v1beta1.IngressBackend) IngressifyRule {
+	ir.ServiceName = backend.ServiceName
+	ir.ServicePort = backend.ServicePort.IntVal
+	ir.ServicePortName = backend.ServicePort.StrVal
+	ir.Hash = hash(ir.Namespace + ir.Name + backend.ServiceName + ir.Host + ir.Path)
+	return ir
+}
+
+// ToEndpoints flattens v1.Endpoints into one Endpoint per address and port, ordered by port name then
+// ready addresses first then by IP
+func ToEndpoints(eps v1.Endpoints) []Endpoint {
+	var res []Endpoint
+	for _, subset := range eps.Subsets {
+		for _, port := range subset.Ports {
+			res = appendEndpoints(res, subset.Addresses, port, true)
+			res = appendEndpoints(res, subset.NotReadyAddresses, port, false)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].PortName != res[j].PortName {
+			return res[i].PortName < res[j].PortName
+		}
+		if res[i].Ready != res[j].Ready {
+			return res[i].Ready
+		}
+		return res[i].IP < res[j].IP
+	})
+	return res
+}
+
+func appendEndpoints(eps []Endpoint, addresses []v1.EndpointAddress, port v1.EndpointPort, ready bool) []Endpoint {
+	for _, addr := range addresses {
+		ep := Endpoint{IP: addr.IP, Hostname: addr.Hostname, Port: port.Port, PortName: port.Name, Ready: ready}
+		if addr.TargetRef != nil && addr.TargetRef.Kind == "Pod" {
+			ep.PodName = addr.TargetRef.Name
+		}
+		eps = append(eps, ep)
+	}
+	return eps
+}
+
+// GroupEndpoints converts Endpoints keyed by namespace/name into their flattened form
+func GroupEndpoints(endpoints map[string]v1.Endpoints) map[string][]Endpoint {
+	m := make(map[string][]Endpoint)
+	for key, eps := range endpoints {
+		m[key] = ToEndpoints(eps)
+	}
+	return m
+}
+
+// WithServices attaches to every rule its service and resolves the service port to both its name and number along
+// with its target port. Rules whose service doesn't exist are flagged as ServiceMissing, they and the rules whose
+// service port doesn't exist get an Error. ExternalName services don't need to declare ports.
+// Rules of the namespaces in `unlisted`, whose services couldn't be listed, only get an Error.
+func WithServices(rules []IngressifyRule, services map[string]v1.Service, unlisted map[string]error) []IngressifyRule {
+	for i := range rules {
+		key := ServiceKey(rules[i].Namespace, rules[i].ServiceName)
+		svc, ok := services[key]
+		if err, found := unlisted[rules[i].Namespace]; !ok && found {
+			rules[i].Error = fmt.Sprintf("service %s could not be looked up: %s", key, err)
+			continue
+		}
+		if !ok {
+			rules[i].ServiceMissing = true
+			rules[i].Error = fmt.Sprintf("service %s not found", key)
+			continue
+		}
+		rules[i].Service = &svc
+		port, ok := servicePort(svc, rules[i])
+		if !ok && svc.Spec.Type == v1.ServiceTypeExternalName && rules[i].ServicePortName == "" {
+			rules[i].TargetPort = rules[i].ServicePort
+			continue
+		}
+		if !ok {
+			rules[i].Error = fmt.Sprintf("service %s has no port %s", key, rulePort(rules[i]))
+			log.Warnf("Rule of ingress %s/%s: %s", rules[i].Namespace, rules[i].Name, rules[i].Error)
+			continue
+		}
+		rules[i].ServicePort = port.Port
+		rules[i].ServicePortName = port.Name
+		switch {
+		case port.TargetPort.Type == intstr.String:
+			rules[i].TargetPortName = port.TargetPort.StrVal
+		case port.TargetPort.IntVal != 0:
+			rules[i].TargetPort = port.TargetPort.IntVal
+		default:
+			rules[i].TargetPort = port.Port
+		}
+	}
+	return rules
+}
+
+// WithoutMissingServices splits `rules` between the ones whose service exists and the ones flagged as ServiceMissing
+func WithoutMissingServices(rules []IngressifyRule) ([]IngressifyRule, []IngressifyRule) {
+	var kept, missing []IngressifyRule
+	for _, rule := range rules {
+		if rule.ServiceMissing {
+			missing = append(missing, rule)
+		} else {
+			kept = append(kept, rule)
+		}
+	}
+	return kept, missing
+}
+
+func rulePort(rule IngressifyRule) string {
+	if rule.ServicePortName != "" {
+		return rule.ServicePortName
+	}
+	return strconv.Itoa(int(rule.ServicePort))
+}
+
+// WithEndpoints attaches to every rule the endpoints of the service port it points to.
+// The service is needed to map the port number of the rule to the port name used by the endpoints,
+// rules whose service is unknown get no endpoints.
+func WithEndpoints(rules []IngressifyRule, services map[string]v1.Service, endpoints map[string]v1.Endpoints) []IngressifyRule {
+	for i := range rules {
+		key := ServiceKey(rules[i].Namespace, rules[i].ServiceName)
+		svc, ok := services[key]
+		if !ok {
+			continue
+		}
+		port, ok := servicePort(svc, rules[i])
+		if !ok {
+			continue
+		}
+		var eps []Endpoint
+		for _, ep := range ToEndpoints(endpoints[key]) {
+			if ep.PortName == port.Name {
+				eps = append(eps, ep)
+			}
+		}
+		rules[i].Endpoints = eps
+		if rules[i].TargetPort == 0 && len(eps) > 0 {
+			// named target ports are only resolved by the endpoints
+			rules[i].TargetPort = eps[0].Port
+		}
+	}
+	return rules
+}
+
+// servicePort returns the service port referenced by the rule, either by name or by number
+func servicePort(svc v1.Service, rule IngressifyRule) (v1.ServicePort, bool) {
+	for _, port := range svc.Spec.Ports {
+		if rule.ServicePortName != "" && port.Name == rule.ServicePortName {
+			return port, true
+		}
+		if rule.ServicePortName == "" && port.Port == rule.ServicePort {
+			return port, true
+		}
+	}
+	return v1.ServicePort{}, false
 }
 
 // IngRules is just an alias to be able to implement custom sorting.
@@ -80,16 +311,54 @@ func (ir IngRules) Less(i, j int) bool {
 	return (len(ir[i].Path) < len(ir[j].Path))
 }
 
-// OrderByPathLen order the rules by Path length in ascending or descending order
+// OrderByPathLen order the rules by Path length in ascending or descending order.
+// Rules with paths of the same length keep their order, and `rules` is left untouched since it may be shared by other
+// templates.
 func OrderByPathLen(rules []IngressifyRule, asc bool) []IngressifyRule {
+	ordered := append([]IngressifyRule{}, rules...)
 	if asc {
-		sort.Sort(sort.Reverse(IngRules(rules)))
+		sort.Stable(sort.Reverse(IngRules(ordered)))
 	} else {
-		sort.Sort(IngRules(rules))
+		sort.Stable(IngRules(ordered))
+	}
+	return ordered
+}
+
+// canonicalLess orders rules by namespace, name, host and path
+func canonicalLess(a IngressifyRule, b IngressifyRule) bool {
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	if a.Name != b.Name {
+		return a.Name < b.Name
 	}
+	if a.Host != b.Host {
+		return a.Host < b.Host
+	}
+	return a.Path < b.Path
+}
+
+// sortRules puts `rules` in canonical order, so the same cluster state always renders the same output whatever the
+// order the API returns ingresses in
+func sortRules(rules []IngressifyRule) []IngressifyRule {
+	sort.SliceStable(rules, func(i, j int) bool { return canonicalLess(rules[i], rules[j]) })
 	return rules
 }
 
+// SortedKeys returns the keys of a map with string keys, e.g. built by GroupByHost, in ascending order
+func SortedKeys(m interface{}) ([]string, error) {
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return nil, fmt.Errorf("SortedKeys expects a map with string keys, got %T", m)
+	}
+	keys := make([]string, 0, v.Len())
+	for _, key := range v.MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
 // GroupByHost returns a map of IngressifyRule grouped by ir.Host
 func GroupByHost(rules []IngressifyRule) map[string][]IngressifyRule {
 	return groupByGeneric(rules, "Host")
@@ -111,9 +380,13 @@ func GroupBySvcNs(rules []IngressifyRule) map[string][]IngressifyRule {
 	  IngressifyRule structure
 */
 func groupByGeneric(rules []IngressifyRule, fields ...string) map[string][]IngressifyRule {
+	return Query{}.groupBy(rules, fields...)
+}
+
+func (q Query) groupBy(rules []IngressifyRule, fields ...string) map[string][]IngressifyRule {
 	m := make(map[string][]IngressifyRule)
 	for _, rule := range rules {
-		value := getGroupingKey(&rule, fields...)
+		value := q.groupingKey(&rule, fields...)
 		if _, ok := m[value]; ok {
 			m[value] = append(m[value], rule)
 		} else {
@@ -123,13 +396,12 @@ func groupByGeneric(rules []IngressifyRule, fields ...string) map[string][]Ingre
 	return m
 }
 
-// getGroupingKey - helper function for groupByGeneric to create the grouping key
-func getGroupingKey(ir *IngressifyRule, fields ...string) string {
-	r := reflect.ValueOf(ir)
+// groupingKey - helper function for groupByGeneric to create the grouping key
+func (q Query) groupingKey(ir *IngressifyRule, fields ...string) string {
 	var key string
 	for _, field := range fields {
-		f := reflect.Indirect(r).FieldByName(field)
-		key = key + "-" + f.String()
+		value, _ := q.fieldString(*ir, field)
+		key = key + "-" + value
 	}
 	return strings.TrimPrefix(key, "-")
 }
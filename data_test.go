@@ -2,12 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"reflect"
+	"sort"
 	"testing"
 
+	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/pkg/util/intstr"
 )
 
 type Set struct {
@@ -53,6 +57,32 @@ func TestToIngressifyRule(t *testing.T) {
 	}
 }
 
+func TestToIngressifyRuleDefaultBackends(t *testing.T) {
+	backend := &v1beta1.IngressBackend{ServiceName: "fallback", ServicePort: intstr.FromString("http")}
+	il := v1beta1.IngressList{Items: []v1beta1.Ingress{
+		{ObjectMeta: v1.ObjectMeta{Name: "only-backend", Namespace: "ns1"},
+			Spec: v1beta1.IngressSpec{Backend: backend}},
+		{ObjectMeta: v1.ObjectMeta{Name: "host-only", Namespace: "ns1"},
+			Spec: v1beta1.IngressSpec{Backend: backend, Rules: []v1beta1.IngressRule{{Host: "foo.com"}}}},
+		{ObjectMeta: v1.ObjectMeta{Name: "no-backend", Namespace: "ns1"},
+			Spec: v1beta1.IngressSpec{Rules: []v1beta1.IngressRule{{Host: "bar.com"}}}},
+	}}
+	rules := ToIngressifyRule(&il)
+	if len(rules) != 1 {
+		t.Fatalf("Wrong number of rules, got: %d, expected: %d", len(rules), 1)
+	}
+	if r := rules[0]; r.Host != "foo.com" || r.ServiceName != "fallback" || r.ServicePortName != "http" || !r.DefaultBackend {
+		t.Errorf("Host without paths should go to the default backend, got: %+v", r)
+	}
+	backends := ToDefaultBackends(&il, nil)
+	if len(backends) != 2 || backends[0].Name != "only-backend" || backends[1].Name != "host-only" {
+		t.Fatalf("Wrong default backends, got: %v", backends)
+	}
+	if b := backends[0]; b.Host != "" || b.Path != "" || b.ServiceName != "fallback" || !b.DefaultBackend {
+		t.Errorf("Wrong default backend, got: %+v", b)
+	}
+}
+
 func TestAsMap(t *testing.T) {
 	testRules := generateRules("./examples/ingressList.json")
 	ingressifyRules := ToIngressifyRule(&testRules)
@@ -215,6 +245,169 @@ func TestOrderByPathLengthDesc(t *testing.T) {
 	}
 }
 
+func TestToIngressifyRuleCanonicalOrder(t *testing.T) {
+	testRules := generateRules("./examples/ingressList.json")
+	expected := ToIngressifyRule(&testRules)
+	for i, j := 0, len(testRules.Items)-1; i < j; i, j = i+1, j-1 {
+		testRules.Items[i], testRules.Items[j] = testRules.Items[j], testRules.Items[i]
+	}
+	if rules := ToIngressifyRule(&testRules); !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Rules should not depend on the order of ingresses, got: %v, expected: %v", rules, expected)
+	}
+	for i := 0; i < len(expected)-1; i++ {
+		if canonicalLess(expected[i+1], expected[i]) {
+			t.Errorf("Rules are not in canonical order, got: %s/%s%s before %s/%s%s", expected[i].Namespace,
+				expected[i].Host, expected[i].Path, expected[i+1].Namespace, expected[i+1].Host, expected[i+1].Path)
+		}
+	}
+}
+
+func TestOrderByPathLenIsStable(t *testing.T) {
+	rules := []IngressifyRule{{Name: "a", Path: "/x"}, {Name: "b", Path: "/long"}, {Name: "c", Path: "/y"}}
+	ordered := OrderByPathLen(rules, false)
+	if ordered[0].Name != "a" || ordered[1].Name != "c" || ordered[2].Name != "b" {
+		t.Errorf("Rules with paths of the same length should keep their order, got: %v", ordered)
+	}
+	ordered = OrderByPathLen(rules, true)
+	if ordered[0].Name != "b" || ordered[1].Name != "a" || ordered[2].Name != "c" {
+		t.Errorf("Rules with paths of the same length should keep their order, got: %v", ordered)
+	}
+	if rules[0].Name != "a" || rules[1].Name != "b" {
+		t.Errorf("Ordering should not modify its input, got: %v", rules)
+	}
+}
+
+func TestSortedKeys(t *testing.T) {
+	testRules := generateRules("./examples/ingressList.json")
+	keys, err := SortedKeys(GroupByHost(ToIngressifyRule(&testRules)))
+	if err != nil || !sort.StringsAreSorted(keys) || len(keys) == 0 {
+		t.Errorf("Keys should be sorted, got: %v (%v)", keys, err)
+	}
+	if _, err = SortedKeys([]string{}); err == nil {
+		t.Errorf("SortedKeys should reject non maps")
+	}
+}
+
+func TestToEndpointsOrder(t *testing.T) {
+	eps := v1.Endpoints{Subsets: []v1.EndpointSubset{
+		{Addresses: []v1.EndpointAddress{{IP: "10.0.0.3"}}, Ports: []v1.EndpointPort{{Name: "http", Port: 80}}},
+		{Addresses: []v1.EndpointAddress{{IP: "10.0.0.2"}}, NotReadyAddresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports: []v1.EndpointPort{{Name: "http", Port: 80}}},
+	}}
+	var ips []string
+	for _, ep := range ToEndpoints(eps) {
+		ips = append(ips, ep.IP)
+	}
+	if expected := []string{"10.0.0.2", "10.0.0.3", "10.0.0.1"}; !reflect.DeepEqual(ips, expected) {
+		t.Errorf("Wrong endpoints order, got: %v, expected: %v", ips, expected)
+	}
+}
+
+func TestWithServices(t *testing.T) {
+	services := map[string]v1.Service{
+		"ns1/svc1": {Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+			{Name: "http", Port: 80, TargetPort: intstr.FromString("web")},
+			{Name: "admin", Port: 8081, TargetPort: intstr.FromInt(9090)},
+			{Name: "metrics", Port: 9100},
+		}}},
+	}
+	rules := WithServices([]IngressifyRule{
+		{Namespace: "ns1", ServiceName: "svc1", ServicePortName: "http"},
+		{Namespace: "ns1", ServiceName: "svc1", ServicePort: 8081},
+		{Namespace: "ns1", ServiceName: "svc1", ServicePortName: "metrics"},
+		{Namespace: "ns1", ServiceName: "svc1", ServicePortName: "missing"},
+		{Namespace: "ns2", ServiceName: "svc1", ServicePort: 80},
+		{Namespace: "ns3", ServiceName: "svc1", ServicePort: 80},
+	}, services, map[string]error{"ns3": errors.New("forbidden")})
+	if r := rules[0]; r.ServicePort != 80 || r.TargetPortName != "web" || r.TargetPort != 0 || r.Error != "" {
+		t.Errorf("Named port should be resolved to its number, got: %+v", r)
+	}
+	if r := rules[1]; r.ServicePortName != "admin" || r.TargetPort != 9090 || r.Error != "" {
+		t.Errorf("Port number should be resolved to its name, got: %+v", r)
+	}
+	if r := rules[2]; r.TargetPort != 9100 {
+		t.Errorf("Target port should default to the service port, got: %d, expected: %d", r.TargetPort, 9100)
+	}
+	if r := rules[3]; r.Error != "service ns1/svc1 has no port missing" {
+		t.Errorf("Unknown port should be reported, got: %q", r.Error)
+	}
+	if r := rules[0]; r.Service == nil || len(r.Service.Spec.Ports) != 3 || r.ServiceMissing {
+		t.Errorf("Service should be attached, got: %v", r.Service)
+	}
+	if r := rules[4]; r.Error != "service ns2/svc1 not found" || r.Service != nil || !r.ServiceMissing {
+		t.Errorf("Unknown service should be reported, got: %q", r.Error)
+	}
+	if r := rules[5]; r.Error != "service ns3/svc1 could not be looked up: forbidden" || r.ServiceMissing {
+		t.Errorf("Service of an unlisted namespace should be reported without being missing, got: %q", r.Error)
+	}
+}
+
+func TestWithoutMissingServices(t *testing.T) {
+	rules := WithServices([]IngressifyRule{
+		{Namespace: "ns1", ServiceName: "svc1", ServicePort: 80},
+		{Namespace: "ns1", ServiceName: "gone", ServicePort: 80},
+	}, map[string]v1.Service{"ns1/svc1": {Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}}}}, nil)
+	kept, missing := WithoutMissingServices(rules)
+	if len(kept) != 1 || kept[0].ServiceName != "svc1" {
+		t.Errorf("Only the rule with an existing service should be kept, got: %v", kept)
+	}
+	if len(missing) != 1 || missing[0].ServiceName != "gone" || missing[0].Error != "service ns1/gone not found" {
+		t.Errorf("Rule with a missing service should be flagged, got: %v", missing)
+	}
+}
+
+func TestWithServicesExternalName(t *testing.T) {
+	services := map[string]v1.Service{
+		"ns1/ext": {Spec: v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "api.example.com"}},
+	}
+	rules := WithServices([]IngressifyRule{{Namespace: "ns1", ServiceName: "ext", ServicePort: 443}}, services, nil)
+	if r := rules[0]; r.Error != "" || r.TargetPort != 443 || r.Service.Spec.ExternalName != "api.example.com" {
+		t.Errorf("ExternalName service without ports should be usable, got: %+v", r)
+	}
+}
+
+func TestWithEndpoints(t *testing.T) {
+	services := map[string]v1.Service{
+		"ns1/svc1": {Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+			{Name: "http", Port: 80},
+			{Name: "admin", Port: 8081},
+		}}},
+	}
+	endpoints := map[string]v1.Endpoints{
+		"ns1/svc1": {Subsets: []v1.EndpointSubset{{
+			Addresses:         []v1.EndpointAddress{{IP: "10.0.0.1", TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "pod1"}}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "10.0.0.2"}},
+			Ports:             []v1.EndpointPort{{Name: "http", Port: 8080}, {Name: "admin", Port: 9090}},
+		}}},
+	}
+	rules := []IngressifyRule{
+		{Namespace: "ns1", ServiceName: "svc1", ServicePort: 80},
+		{Namespace: "ns1", ServiceName: "svc1", ServicePortName: "admin"},
+		{Namespace: "ns1", ServiceName: "svc1", ServicePort: 1234},
+		{Namespace: "ns2", ServiceName: "svc1", ServicePort: 80},
+	}
+	rules = WithEndpoints(rules, services, endpoints)
+	expected := []Endpoint{
+		{IP: "10.0.0.1", PodName: "pod1", Port: 8080, PortName: "http", Ready: true},
+		{IP: "10.0.0.2", Port: 8080, PortName: "http", Ready: false},
+	}
+	if !reflect.DeepEqual(rules[0].Endpoints, expected) {
+		t.Errorf("Wrong endpoints for port number, got: %v, expected: %v", rules[0].Endpoints, expected)
+	}
+	if len(rules[1].Endpoints) != 2 || rules[1].Endpoints[0].Port != 9090 {
+		t.Errorf("Wrong endpoints for port name, got: %v", rules[1].Endpoints)
+	}
+	if rules[1].TargetPort != 9090 {
+		t.Errorf("Target port should be resolved by the endpoints, got: %d, expected: %d", rules[1].TargetPort, 9090)
+	}
+	if len(rules[2].Endpoints) != 0 {
+		t.Errorf("Unknown service port should have no endpoints, got: %v", rules[2].Endpoints)
+	}
+	if len(rules[3].Endpoints) != 0 {
+		t.Errorf("Unknown service should have no endpoints, got: %v", rules[3].Endpoints)
+	}
+}
+
 func isIngressifyRulePresent(ir IngressifyRule, irs []IngressifyRule) bool {
 	for _, r := range irs {
 		if ir.Namespace == r.Namespace && ir.Name == r.Name && ir.ServicePort == r.ServicePort &&
@@ -0,0 +1,34 @@
+package main
+
+import "time"
+
+// DEBOUNCEINTERVAL is the time events are coalesced for before triggering a render
+const DEBOUNCEINTERVAL = 500 * time.Millisecond
+
+// Debounce coalesces signals received on `in` and forwards a single one on the returned channel
+// `wait` after the first signal of a burst. The returned channel is closed once `in` is closed.
+func Debounce(in <-chan struct{}, wait time.Duration) <-chan struct{} {
+	out := make(chan struct{}, 1)
+	go func() {
+		defer close(out)
+		var pending <-chan time.Time
+		for {
+			select {
+			case _, ok := <-in:
+				if !ok {
+					return
+				}
+				if pending == nil {
+					pending = time.After(wait)
+				}
+			case <-pending:
+				pending = nil
+				select {
+				case out <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDebounce_should_coalesce_bursts(t *testing.T) {
+	in := make(chan struct{}, 10)
+	out := Debounce(in, 50*time.Millisecond)
+	for i := 0; i < 5; i++ {
+		in <- struct{}{}
+	}
+	select {
+	case <-out:
+	case <-time.After(time.Second):
+		t.Fatalf("Debounce did not forward the burst")
+	}
+	select {
+	case <-out:
+		t.Errorf("Debounce forwarded more than one signal for a single burst")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestDebounce_should_close_when_input_closes(t *testing.T) {
+	in := make(chan struct{})
+	out := Debounce(in, 50*time.Millisecond)
+	close(in)
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Errorf("Expected output channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Output channel was not closed")
+	}
+}
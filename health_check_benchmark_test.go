@@ -8,7 +8,7 @@ import (
 
 func init() {
 	var opsReport = make(chan *OpsStatus, 10)
-	go runHealthCheckServer(opsReport, REFRESHINTERVAL, PORT)
+	go newHealthCheckServer(opsReport, REFRESHINTERVAL, PORT).ListenAndServe()
 }
 
 func BenchmarkBootstrapHealthCheck(b *testing.B) {
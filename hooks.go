@@ -1,25 +1,533 @@
 package main
 
 import (
-	"github.com/apex/log"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
 )
 
-// Hook is a struct that contains the pre-render and post-render scripts to be executed
+// FILEPLACEHOLDER is replaced by the path of the rendered file in the arguments and HTTP requests of the validate hook
+const FILEPLACEHOLDER = "{{file}}"
+
+// HOOKTIMEOUT is how long a hook may run before its process group is killed, unless configured otherwise
+const HOOKTIMEOUT = 2 * time.Minute
+
+// HOOKOUTPUTWAIT is how long the outputs of a hook are still read once it exited or was killed, processes it left
+// behind, e.g. daemons started with setsid, may keep them open
+const HOOKOUTPUTWAIT = 500 * time.Millisecond
+
+// HOOKBACKOFF is the delay before the first retry of a failed hook step, unless configured otherwise
+const HOOKBACKOFF = time.Second
+
+// Hook is a struct that contains the pre-render, validate, post-render and on-failure scripts to be executed,
+// along with the timeout of each script and the environment variables they get
 type Hook struct {
-	PreRender  []string `json:"pre_render"`
-	PostRender []string `json:"post_render"`
+	PreRender  HookSteps         `json:"pre_render"`
+	Validate   HookSteps         `json:"validate"`
+	PostRender HookSteps         `json:"post_render"`
+	OnFailure  HookSteps         `json:"on_failure"`
+	Timeout    string            `json:"timeout"`
+	Env        map[string]string `json:"env"`
+}
+
+// Prepare parses the body templates of the HTTP steps of the hook with `funcs` and checks its signal steps
+func (h Hook) Prepare(funcs template.FuncMap) error {
+	for _, steps := range []HookSteps{h.PreRender, h.Validate, h.PostRender, h.OnFailure} {
+		for _, step := range steps {
+			if step.HTTP != nil {
+				if err := step.HTTP.prepare(funcs); err != nil {
+					return err
+				}
+			}
+			if step.Signal != nil {
+				if err := step.Signal.check(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// HookStep is a command, an HTTP request or a signal sent to a process. A failed step is retried `Retries` times,
+// waiting `Backoff` before the first retry and twice as long before every next one. With `ContinueOnError` its failure
+// is logged but doesn't fail the hook.
+type HookStep struct {
+	Command         []string    `json:"command"`
+	HTTP            *HTTPHook   `json:"http"`
+	Signal          *SignalHook `json:"signal"`
+	Retries         int         `json:"retries"`
+	Backoff         string      `json:"backoff"`
+	ContinueOnError bool        `json:"continue_on_error"`
+}
+
+// kinds returns how many of a command, an HTTP request and a signal the step has
+func (s HookStep) kinds() int {
+	n := 0
+	for _, set := range []bool{len(s.Command) > 0, s.HTTP != nil, s.Signal != nil} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// command returns the command of the step, or a description of its request or signal
+func (s HookStep) command() []string {
+	switch {
+	case s.HTTP != nil:
+		return []string{s.HTTP.method() + " " + s.HTTP.URL}
+	case s.Signal != nil:
+		return []string{"signal " + s.Signal.target()}
+	}
+	return s.Command
+}
+
+func (s HookStep) run(opts HookOptions) (HookResult, error) {
+	switch {
+	case s.HTTP != nil:
+		return s.HTTP.Run(opts)
+	case s.Signal != nil:
+		return s.Signal.Run(opts)
+	}
+	return RunHook(s.Command, opts)
+}
+
+func (s HookStep) getBackoff() (time.Duration, error) {
+	if s.Backoff == "" {
+		return HOOKBACKOFF, nil
+	}
+	backoff, err := time.ParseDuration(s.Backoff)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid hook backoff %q", s.Backoff)
+	}
+	return backoff, nil
+}
+
+// HookSteps are the commands of a hook, run in order
+type HookSteps []HookStep
+
+// UnmarshalJSON accepts a single command, e.g. `[systemctl, reload, haproxy]`, or a list of steps,
+// each of them being a command or an object
+func (s *HookSteps) UnmarshalJSON(data []byte) error {
+	var command []string
+	if err := json.Unmarshal(data, &command); err == nil {
+		*s = nil
+		if len(command) > 0 {
+			*s = HookSteps{{Command: command}}
+		}
+		return nil
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return errors.Wrap(err, "hook must be a command or a list of steps")
+	}
+	steps := make(HookSteps, 0, len(raw))
+	for i, r := range raw {
+		var step HookStep
+		if err := json.Unmarshal(r, &step.Command); err != nil {
+			if err = json.Unmarshal(r, &step); err != nil {
+				return errors.Wrapf(err, "invalid hook step %d", i+1)
+			}
+		}
+		if step.kinds() != 1 {
+			return fmt.Errorf("hook step %d must have exactly one of command, http and signal", i+1)
+		}
+		steps = append(steps, step)
+	}
+	*s = steps
+	return nil
+}
+
+// WithFile returns a copy of the steps with FILEPLACEHOLDER replaced by `file` in the arguments of their commands and
+// in the url and body of their HTTP requests
+func (s HookSteps) WithFile(file string) HookSteps {
+	res := make(HookSteps, len(s))
+	for i, step := range s {
+		step.Command = WithFile(step.Command, file)
+		if step.HTTP != nil {
+			step.HTTP = step.HTTP.withFile(file)
+		}
+		res[i] = step
+	}
+	return res
+}
+
+// HookOptions tune the execution of a hook, Context is the data HTTP hooks render their body from.
+// When Stop is closed, on shutdown, running hooks are killed and no step is started anymore.
+type HookOptions struct {
+	Timeout time.Duration
+	Env     []string
+	Context ICxt
+	Stop    <-chan struct{}
+}
+
+// hookOptions merges the timeout and environment of `hooks`, the later ones taking precedence, with the variables
+// describing the cycle
+func hookOptions(cycle Cycle, hooks ...Hook) (HookOptions, error) {
+	opts := HookOptions{Timeout: HOOKTIMEOUT, Stop: cycle.Stop}
+	if cycle.Context != nil {
+		opts.Context = *cycle.Context
+	}
+	env := make(map[string]string)
+	for _, hook := range hooks {
+		if hook.Timeout != "" {
+			timeout, err := time.ParseDuration(hook.Timeout)
+			if err != nil {
+				return opts, errors.Wrapf(err, "invalid hook timeout %q", hook.Timeout)
+			}
+			opts.Timeout = timeout
+		}
+		for k, v := range hook.Env {
+			env[k] = v
+		}
+	}
+	for k, v := range env {
+		opts.Env = append(opts.Env, k+"="+v)
+	}
+	sort.Strings(opts.Env)
+	opts.Env = append(opts.Env, cycle.Env()...)
+	return opts, nil
+}
+
+// HookResult is the outcome of a hook execution. ExitCode is -1 when the hook could not be run,
+// and 128 + the signal number when it was killed, e.g. on timeout.
+// Hook and Step tell which step of which hook it is, Attempts how many times it was run.
+// For HTTP steps Command is the method and the URL, Status the status of the response, and ExitCode is 1 when
+// the status is not expected. Stopped tells whether the hook was killed, or not run, because of a shutdown.
+type HookResult struct {
+	Hook     string
+	Step     int
+	Attempts int
+	Command  []string
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Status   int
+	Duration time.Duration
+	TimedOut bool
+	Stopped  bool
+}
+
+// HookError is returned when a hook fails, it carries the result of the hook
+type HookError struct {
+	HookResult
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *HookError) Error() string {
+	var msg string
+	switch {
+	case e.TimedOut:
+		msg = fmt.Sprintf("hook %s timed out after %s", e.Command[0], e.Timeout)
+	case e.Stopped:
+		msg = fmt.Sprintf("hook %s was stopped on shutdown", e.Command[0])
+	case e.ExitCode == -1:
+		msg = fmt.Sprintf("hook %s could not be run: %s", e.Command[0], e.Err)
+	case e.Status != 0:
+		msg = fmt.Sprintf("hook %s returned status %d", e.Command[0], e.Status)
+	default:
+		msg = fmt.Sprintf("hook %s exited with code %d", e.Command[0], e.ExitCode)
+	}
+	if stderr := lastLine(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+// lastLine returns the last non blank line of `s`, usually the most relevant one of error outputs
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// WithFile returns a copy of `hook` with FILEPLACEHOLDER replaced by `file` in its arguments
+func WithFile(hook []string, file string) []string {
+	res := make([]string, len(hook))
+	for i, arg := range hook {
+		res[i] = strings.Replace(arg, FILEPLACEHOLDER, file, -1)
+	}
+	return res
+}
+
+// Cycle describes a render cycle, hooks get it through INGRESSIFY_* environment variables.
+// OutFile is the output a hook relates to, the first one for global hooks. Checksum is the one of OutFile,
+// Changed tells whether it changed, or whether any output changed for global hooks.
+// Error is the reason of the failure of the cycle, for the on-failure hook.
+// Context is the data the outputs were rendered from, nil until they are. Stop is closed when running hooks must be
+// killed, at the end of the grace period of a shutdown.
+type Cycle struct {
+	ID        uint64
+	Trigger   string
+	OutFile   string
+	OutFiles  []string
+	Checksum  string
+	Changed   bool
+	Error     string
+	Timestamp time.Time
+	Context   *ICxt
+	Stop      <-chan struct{}
+}
+
+// ForOutput returns a copy of the cycle for hooks related to the rendered output `pending`
+func (c Cycle) ForOutput(pending *PendingOutput) Cycle {
+	c.OutFile = pending.OutPath
+	c.Checksum = pending.Checksum
+	c.Changed = pending.Changed
+	return c
+}
+
+// Env returns the environment variables describing the cycle
+func (c Cycle) Env() []string {
+	outFile := c.OutFile
+	if outFile == "" && len(c.OutFiles) > 0 {
+		outFile = c.OutFiles[0]
+	}
+	return []string{
+		fmt.Sprintf("INGRESSIFY_CYCLE_ID=%d", c.ID),
+		fmt.Sprintf("INGRESSIFY_TRIGGER=%s", c.Trigger),
+		fmt.Sprintf("INGRESSIFY_OUT_FILE=%s", outFile),
+		fmt.Sprintf("INGRESSIFY_OUT_FILES=%s", strings.Join(c.OutFiles, ",")),
+		fmt.Sprintf("INGRESSIFY_CHECKSUM=%s", c.Checksum),
+		fmt.Sprintf("INGRESSIFY_CHANGED=%t", c.Changed),
+		fmt.Sprintf("INGRESSIFY_ERROR=%s", c.Error),
+		fmt.Sprintf("INGRESSIFY_TIMESTAMP=%s", c.Timestamp.Format(time.RFC3339)),
+	}
 }
 
 // ExecHook executes an array of commands
 func ExecHook(hook []string) (string, error) {
-	run := exec.Command(hook[0], hook[1:]...)
-	log.Info("Executing hook")
-	out, err := run.Output()
+	return ExecHookWithEnv(hook, nil)
+}
+
+// ExecHookWithEnv executes an array of commands with `env` added to the environment of the process.
+// An empty hook is a no-op.
+func ExecHookWithEnv(hook []string, env []string) (string, error) {
+	res, err := RunHook(hook, HookOptions{Env: env})
 	if err != nil {
-		log.WithError(err).Error("Failed to run hook")
 		return "", err
 	}
+	return res.Stdout, nil
+}
+
+// RunHook executes an array of commands with the environment variables of `opts` added to the environment of the
+// process. The hook runs in its own process group, which is killed when it doesn't finish within the timeout.
+// An empty hook is a no-op, a failed one returns a *HookError.
+func RunHook(hook []string, opts HookOptions) (HookResult, error) {
+	res := HookResult{Command: hook}
+	if len(hook) == 0 {
+		return res, nil
+	}
+	run := exec.Command(hook[0], hook[1:]...)
+	run.Env = append(os.Environ(), opts.Env...)
+	run.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, stderr, err := newHookOutputs()
+	if err != nil {
+		res.ExitCode = -1
+		herr := &HookError{HookResult: res, Timeout: opts.Timeout, Err: err}
+		log.WithError(herr).Error("Failed to run hook")
+		return res, herr
+	}
+	run.Stdout = stdout.w
+	run.Stderr = stderr.w
+	log.Infof("Executing hook %s", hook[0])
+	start := time.Now()
+	err = run.Start()
+	stdout.read()
+	stderr.read()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() { done <- run.Wait() }()
+		var timeout <-chan time.Time
+		if opts.Timeout > 0 {
+			timer := time.NewTimer(opts.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case err = <-done:
+		case <-timeout:
+			res.TimedOut = true
+			syscall.Kill(-run.Process.Pid, syscall.SIGKILL)
+			err = <-done
+		case <-opts.Stop:
+			res.Stopped = true
+			syscall.Kill(-run.Process.Pid, syscall.SIGKILL)
+			err = <-done
+		}
+	}
+	giveUp := time.Now().Add(HOOKOUTPUTWAIT)
+	if read := stdout.wait(giveUp); !stderr.wait(giveUp) || !read {
+		log.Warnf("Processes left behind by hook %s keep its outputs open, not reading them anymore", hook[0])
+	}
+	res.Duration = time.Since(start)
+	res.Stdout = stdout.String()
+	res.Stderr = stderr.String()
+	res.ExitCode = exitCode(err)
+	if err != nil {
+		herr := &HookError{HookResult: res, Timeout: opts.Timeout, Err: err}
+		log.WithError(herr).Error("Failed to run hook")
+		return res, herr
+	}
 	log.Info("Hook execution successful")
-	return string(out), nil
+	return res, nil
+}
+
+// hookOutput is an output of a hook read through a pipe rather than by exec, so that it can be given up on when
+// processes left behind by the hook keep it open: Cmd.Wait would wait for them
+type hookOutput struct {
+	r, w *os.File
+	buf  bytes.Buffer
+	done chan struct{}
+}
+
+// newHookOutputs returns the stdout and stderr of a hook
+func newHookOutputs() (*hookOutput, *hookOutput, error) {
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create pipe")
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		outR.Close()
+		outW.Close()
+		return nil, nil, errors.Wrap(err, "failed to create pipe")
+	}
+	return &hookOutput{r: outR, w: outW, done: make(chan struct{})}, &hookOutput{r: errR, w: errW, done: make(chan struct{})}, nil
+}
+
+// read closes the write end, inherited by the hook, and reads the output until every writer closed it
+func (o *hookOutput) read() {
+	o.w.Close()
+	go func() {
+		defer close(o.done)
+		io.Copy(&o.buf, o.r)
+	}()
+}
+
+// wait waits for the output to be read until `giveUp`. It then closes the read end so that the output can be
+// used, and returns false.
+func (o *hookOutput) wait(giveUp time.Time) bool {
+	timer := time.NewTimer(time.Until(giveUp))
+	defer timer.Stop()
+	select {
+	case <-o.done:
+		o.r.Close()
+		return true
+	case <-timer.C:
+		o.r.Close()
+		<-o.done
+		return false
+	}
+}
+
+func (o *hookOutput) String() string {
+	return o.buf.String()
+}
+
+// RunSteps runs the steps of the hook `name` in order with `opts`, returning the result of each of them.
+// It stops at the first step still failing after its retries, unless that step continues on error.
+func RunSteps(name string, steps HookSteps, opts HookOptions) ([]HookResult, error) {
+	var results []HookResult
+	for i, step := range steps {
+		res, err := runStep(name, step, opts)
+		res.Hook, res.Step = name, i+1
+		results = append(results, res)
+		if err == nil {
+			continue
+		}
+		if step.ContinueOnError {
+			log.WithError(err).Warnf("Step %d of %s hook failed, continuing", i+1, name)
+			continue
+		}
+		if len(steps) > 1 {
+			err = errors.Wrapf(err, "step %d of %d", i+1, len(steps))
+		}
+		return results, err
+	}
+	return results, nil
+}
+
+// runStep runs `step` until it succeeds or has no retry left, logging the output of every attempt
+func runStep(name string, step HookStep, opts HookOptions) (HookResult, error) {
+	backoff, err := step.getBackoff()
+	if err != nil {
+		return HookResult{Command: step.command(), ExitCode: -1}, err
+	}
+	for attempt := 1; ; attempt++ {
+		if stopped(opts) {
+			res := HookResult{Command: step.command(), ExitCode: -1, Stopped: true, Attempts: attempt - 1}
+			return res, &HookError{HookResult: res, Err: errors.New("shutting down")}
+		}
+		start := time.Now()
+		res, err := step.run(opts)
+		metrics.ObserveHook(name, start, err)
+		res.Attempts = attempt
+		logOutput(name, res)
+		if err == nil || attempt > step.Retries {
+			return res, err
+		}
+		log.WithError(err).Warnf("Retrying %s hook in %s (%d/%d)", name, backoff, attempt, step.Retries)
+		select {
+		case <-time.After(backoff):
+		case <-opts.Stop:
+		}
+		backoff *= 2
+	}
+}
+
+// stopped tells whether hooks must not be run anymore
+func stopped(opts HookOptions) bool {
+	select {
+	case <-opts.Stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func logOutput(name string, res HookResult) {
+	if res.Stdout != "" {
+		log.Infof("Output from %s hook", name)
+		fmt.Println(res.Stdout)
+	}
+	if res.Stderr != "" {
+		log.Warnf("Error output from %s hook", name)
+		fmt.Println(res.Stderr)
+	}
+}
+
+// ExitCode returns the exit code of a hook given the error it returned, 0 on success and -1 when it could not be run
+func ExitCode(err error) int {
+	if herr, ok := errors.Cause(err).(*HookError); ok {
+		return herr.ExitCode
+	}
+	return exitCode(err)
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal())
+			}
+			return status.ExitStatus()
+		}
+	}
+	return -1
 }
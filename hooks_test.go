@@ -1,7 +1,17 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
 )
 
 func TestExecHook(t *testing.T) {
@@ -15,3 +25,205 @@ func TestExecHook(t *testing.T) {
 		t.Errorf("ExecHook did not return output of command, got: %s, expected: %s", str, msg)
 	}
 }
+
+func TestExecHookWithEnv(t *testing.T) {
+	cycle := Cycle{ID: 42, Trigger: "watch", OutFile: "/tmp/out"}
+	str, err := ExecHookWithEnv([]string{"/bin/sh", "-c", "echo -n $INGRESSIFY_CYCLE_ID $INGRESSIFY_TRIGGER $INGRESSIFY_OUT_FILE"}, cycle.Env())
+	if err != nil {
+		t.Errorf("Failed to execute sh command: %s", err)
+	}
+	if expected := "42 watch /tmp/out"; str != expected {
+		t.Errorf("Cycle was not passed to the hook, got: %s, expected: %s", str, expected)
+	}
+}
+
+func TestExecHookWithEmptyHook(t *testing.T) {
+	str, err := ExecHook([]string{})
+	if err != nil || str != "" {
+		t.Errorf("Empty hook should be a no-op, got: %s, %s", str, err)
+	}
+}
+
+func TestWithFile(t *testing.T) {
+	hook := []string{"haproxy", "-c", "-f", "{{file}}"}
+	res := WithFile(hook, "/tmp/haproxy.cfg")
+	if res[3] != "/tmp/haproxy.cfg" {
+		t.Errorf("Placeholder not replaced, got: %s", res[3])
+	}
+	if hook[3] != "{{file}}" {
+		t.Errorf("Original hook should not be modified")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	_, err := ExecHook([]string{"/bin/sh", "-c", "exit 3"})
+	if code := ExitCode(err); code != 3 {
+		t.Errorf("Wrong exit code, got: %d, expected: %d", code, 3)
+	}
+	_, err = ExecHook([]string{"/does/not/exist"})
+	if code := ExitCode(err); code != -1 {
+		t.Errorf("Wrong exit code, got: %d, expected: %d", code, -1)
+	}
+	if code := ExitCode(nil); code != 0 {
+		t.Errorf("Wrong exit code, got: %d, expected: %d", code, 0)
+	}
+}
+
+func TestRunHookCapturesOutputs(t *testing.T) {
+	res, err := RunHook([]string{"/bin/sh", "-c", "echo out; echo oops >&2; echo failed >&2; exit 2"}, HookOptions{})
+	if res.Stdout != "out\n" || res.Stderr != "oops\nfailed\n" {
+		t.Errorf("Outputs not captured, got: %q and %q", res.Stdout, res.Stderr)
+	}
+	if res.ExitCode != 2 || ExitCode(err) != 2 {
+		t.Errorf("Wrong exit code, got: %d, expected: %d", res.ExitCode, 2)
+	}
+	if expected := "hook /bin/sh exited with code 2: failed"; err == nil || err.Error() != expected {
+		t.Errorf("Wrong error, got: %v, expected: %s", err, expected)
+	}
+}
+
+func TestRunHookTimeoutKillsProcessGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingressify")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	pidfile := filepath.Join(dir, "child.pid")
+	start := time.Now()
+	res, err := RunHook([]string{"/bin/sh", "-c", "sleep 30 & echo $! > " + pidfile + "; wait"},
+		HookOptions{Timeout: 200 * time.Millisecond})
+	if time.Since(start) > time.Second {
+		t.Errorf("Hook was not stopped on timeout")
+	}
+	if !res.TimedOut || err == nil || !strings.Contains(err.Error(), "timed out after 200ms") {
+		t.Errorf("Timeout not reported, got: %v", err)
+	}
+	if code := ExitCode(err); code != 128+int(syscall.SIGKILL) {
+		t.Errorf("Wrong exit code, got: %d, expected: %d", code, 128+int(syscall.SIGKILL))
+	}
+	data, err := ioutil.ReadFile(pidfile)
+	if err != nil {
+		t.Fatalf("Child of the hook did not start: %s", err)
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	// the killed child may linger as a zombie when nothing reaps orphans
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, state, _, err := procStat(pid); err != nil || state == "Z" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("Child %d of the hook survived the timeout", pid)
+			break
+		}
+	}
+}
+
+func TestRunHookDoesNotWaitForProcessesLeftBehind(t *testing.T) {
+	start := time.Now()
+	// the daemon leaves the process group of the hook but keeps its outputs open
+	res, err := RunHook([]string{"/bin/sh", "-c", "echo started; setsid sleep 5 & exit 0"}, HookOptions{Timeout: time.Second})
+	if elapsed := time.Since(start); elapsed > time.Second+HOOKOUTPUTWAIT {
+		t.Errorf("Hook should not wait for the processes it left behind, took: %s", elapsed)
+	}
+	if err != nil || res.Stdout != "started\n" {
+		t.Errorf("Hook should succeed with its output, got: %q (%v)", res.Stdout, err)
+	}
+}
+
+func TestHookOptions(t *testing.T) {
+	global := Hook{Timeout: "10s", Env: map[string]string{"A": "global", "B": "global"}}
+	output := Hook{Env: map[string]string{"B": "output"}}
+	cycle := Cycle{ID: 1, OutFile: "/tmp/out", Checksum: "abc", Changed: true}
+	opts, err := hookOptions(cycle, global, output)
+	if err != nil || opts.Timeout != 10*time.Second {
+		t.Errorf("Wrong timeout, got: %s (%v), expected: %s", opts.Timeout, err, 10*time.Second)
+	}
+	str, err := ExecHookWithEnv([]string{"/bin/sh", "-c", "echo -n $A $B $INGRESSIFY_CHECKSUM $INGRESSIFY_CHANGED"}, opts.Env)
+	if expected := "global output abc true"; err != nil || str != expected {
+		t.Errorf("Wrong environment, got: %s (%v), expected: %s", str, err, expected)
+	}
+	if opts, _ = hookOptions(cycle); opts.Timeout != HOOKTIMEOUT {
+		t.Errorf("Wrong default timeout, got: %s, expected: %s", opts.Timeout, HOOKTIMEOUT)
+	}
+	if _, err = hookOptions(cycle, Hook{Timeout: "soon"}); err == nil {
+		t.Errorf("Invalid timeout should fail")
+	}
+}
+
+func TestHookStepsUnmarshal(t *testing.T) {
+	var hook Hook
+	err := yaml.Unmarshal([]byte(`
+pre_render: [/bin/true]
+post_render:
+  - [/bin/echo, reloading]
+  - command: [systemctl, reload, haproxy]
+    retries: 2
+    backoff: 500ms
+    continue_on_error: true
+`), &hook)
+	if err != nil {
+		t.Fatalf("Failed to parse hooks: %s", err)
+	}
+	if len(hook.PreRender) != 1 || len(hook.PreRender[0].Command) != 1 {
+		t.Errorf("A single command should be a single step, got: %+v", hook.PreRender)
+	}
+	expected := HookSteps{
+		{Command: []string{"/bin/echo", "reloading"}},
+		{Command: []string{"systemctl", "reload", "haproxy"}, Retries: 2, Backoff: "500ms", ContinueOnError: true},
+	}
+	if !reflect.DeepEqual(hook.PostRender, expected) {
+		t.Errorf("Wrong steps, got: %+v, expected: %+v", hook.PostRender, expected)
+	}
+	if err = yaml.Unmarshal([]byte("validate:\n  - retries: 1\n"), &hook); err == nil {
+		t.Errorf("Step without command should be rejected")
+	}
+}
+
+func TestRunStepsRetries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingressify")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	counter := filepath.Join(dir, "attempts")
+	// fails until it ran 3 times
+	flaky := []string{"/bin/sh", "-c", "echo x >> " + counter + "; test $(wc -l < " + counter + ") -ge 3"}
+	results, err := RunSteps("post_render", HookSteps{{Command: flaky, Retries: 2, Backoff: "10ms"}}, HookOptions{})
+	if err != nil || len(results) != 1 || results[0].Attempts != 3 {
+		t.Errorf("Step should succeed on its last retry, got: %+v (%v)", results, err)
+	}
+	os.Remove(counter)
+	results, err = RunSteps("post_render", HookSteps{{Command: flaky, Retries: 1, Backoff: "10ms"}}, HookOptions{})
+	if err == nil || results[0].Attempts != 2 || results[0].ExitCode != 1 {
+		t.Errorf("Step should fail once out of retries, got: %+v (%v)", results, err)
+	}
+}
+
+func TestRunStepsFailurePolicy(t *testing.T) {
+	fail := []string{"/bin/sh", "-c", "exit 4"}
+	echo := []string{"/bin/echo", "-n", "done"}
+	results, err := RunSteps("post_render", HookSteps{{Command: fail, ContinueOnError: true}, {Command: echo}}, HookOptions{})
+	if err != nil || len(results) != 2 || results[0].ExitCode != 4 || results[1].Stdout != "done" {
+		t.Errorf("Failure should be ignored with continue_on_error, got: %+v (%v)", results, err)
+	}
+	if results[1].Hook != "post_render" || results[1].Step != 2 {
+		t.Errorf("Step not recorded, got: %s step %d", results[1].Hook, results[1].Step)
+	}
+	results, err = RunSteps("post_render", HookSteps{{Command: fail}, {Command: echo}}, HookOptions{})
+	if len(results) != 1 || ExitCode(err) != 4 || !strings.HasPrefix(err.Error(), "step 1 of 2: ") {
+		t.Errorf("Failure should stop the hook, got: %+v (%v)", results, err)
+	}
+}
+
+func TestRunHookStop(t *testing.T) {
+	stop := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(stop) })
+	res, err := RunHook([]string{"/bin/sleep", "30"}, HookOptions{Stop: stop})
+	if !res.Stopped || err == nil || !strings.Contains(err.Error(), "stopped on shutdown") {
+		t.Errorf("Hook should be stopped, got: %+v (%v)", res, err)
+	}
+	results, err := RunSteps("post_render", HookSteps{{HTTP: &HTTPHook{URL: "http://localhost"}}}, HookOptions{Stop: stop})
+	if err == nil || len(results) != 1 || !results[0].Stopped || results[0].Attempts != 0 {
+		t.Errorf("No step should be run once stopped, got: %+v (%v)", results, err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
+	apierrors "k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/unversioned"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/pkg/runtime"
+	"k8s.io/client-go/pkg/watch"
+)
+
+// DEFAULTCLASSANNOTATION marks the IngressClass unclassed ingresses belong to
+const DEFAULTCLASSANNOTATION = "ingressclass.kubernetes.io/is-default-class"
+
+// NetworkingIngressClassList is a networking.k8s.io/v1 IngressClassList
+type NetworkingIngressClassList struct {
+	unversioned.TypeMeta `json:",inline"`
+	unversioned.ListMeta `json:"metadata,omitempty"`
+	Items                []NetworkingIngressClass `json:"items"`
+}
+
+// NetworkingIngressClass is a networking.k8s.io/v1 IngressClass
+type NetworkingIngressClass struct {
+	unversioned.TypeMeta `json:",inline"`
+	v1.ObjectMeta        `json:"metadata,omitempty"`
+	Spec                 NetworkingIngressClassSpec `json:"spec,omitempty"`
+}
+
+// NetworkingIngressClassSpec is a networking.k8s.io/v1 IngressClassSpec
+type NetworkingIngressClassSpec struct {
+	Controller string `json:"controller,omitempty"`
+}
+
+// ScrapeIngressClasses retrieves the IngressClass resources, none when the cluster doesn't serve them
+// or ingressify is not allowed to list them
+func ScrapeIngressClasses(client kubernetes.Interface) ([]NetworkingIngressClass, error) {
+	log.Info("Fetching IngressClasses")
+	raw, err := client.CoreV1().RESTClient().Get().AbsPath("/apis", NETWORKINGV1, "ingressclasses").Do().Raw()
+	if apierrors.IsNotFound(err) {
+		log.Infof("IngressClasses are not served by the cluster")
+		return nil, nil
+	}
+	if apierrors.IsForbidden(err) {
+		log.WithError(err).Warn("Not allowed to list IngressClasses, ignoring ingress_controller and default classes")
+		return nil, nil
+	}
+	if err != nil {
+		log.WithError(err).Error("Failed to get list of IngressClasses")
+		return nil, err
+	}
+	var list NetworkingIngressClassList
+	if err = json.Unmarshal(raw, &list); err != nil {
+		return nil, errors.Wrap(err, "failed to decode IngressClasses")
+	}
+	return list.Items, nil
+}
+
+// usesClasses tells whether ingresses are filtered by class at all
+func (s Scope) usesClasses() bool {
+	return s.IngressClass != "" || s.IngressController != ""
+}
+
+// needsClasses tells whether the IngressClasses are needed to filter `il` by class: to find the classes
+// of `ingress_controller`, or the default class of unclassed ingresses
+func (s Scope) needsClasses(il *v1beta1.IngressList, converted Converted) bool {
+	if s.IngressController != "" {
+		return true
+	}
+	for _, ing := range il.Items {
+		if converted.Class(ing) == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchIngressClasses watches networking.k8s.io/v1 IngressClasses, it behaves like WatchIngresses
+func WatchIngressClasses(client kubernetes.Interface, events chan<- struct{}, stop <-chan struct{}) {
+	watchResource("ingressclasses", func(opts v1.ListOptions) (watch.Interface, error) {
+		stream, err := client.CoreV1().RESTClient().Get().AbsPath("/apis", NETWORKINGV1, "ingressclasses").
+			Param("watch", "true").Param("resourceVersion", opts.ResourceVersion).Stream()
+		if err != nil {
+			return nil, err
+		}
+		return watch.NewStreamWatcher(&networkingWatchDecoder{stream: stream, decoder: json.NewDecoder(stream),
+			object: func() runtime.Object { return &NetworkingIngressClass{} }}), nil
+	}, nil, events, stop)
+}
+
+// ClassFilter returns a predicate telling whether an ingress of the given class belongs to the classes of the scope.
+// The classes are `ingress_class` and the IngressClasses whose controller is `ingress_controller`.
+// Unclassed ingresses belong to the IngressClass marked as default if any, otherwise they are only
+// claimed with `claim_unclassed`.
+func (s Scope) ClassFilter(classes []NetworkingIngressClass) func(class string) bool {
+	if !s.usesClasses() {
+		return func(string) bool { return true }
+	}
+	ours := make(map[string]bool)
+	if s.IngressClass != "" {
+		ours[s.IngressClass] = true
+	}
+	var defaultClass string
+	for _, class := range classes {
+		if s.IngressController != "" && class.Spec.Controller == s.IngressController {
+			ours[class.Name] = true
+		}
+		if class.Annotations[DEFAULTCLASSANNOTATION] == "true" {
+			defaultClass = class.Name
+		}
+	}
+	return func(class string) bool {
+		if class == "" && defaultClass != "" {
+			return ours[defaultClass]
+		}
+		if class == "" {
+			return s.ClaimUnclassed
+		}
+		return ours[class]
+	}
+}
+
+// FilterIngressClass drops the ingresses not belonging to our classes, see Converted.Class
+func FilterIngressClass(il *v1beta1.IngressList, converted Converted, ours func(class string) bool) *v1beta1.IngressList {
+	res := &v1beta1.IngressList{ListMeta: il.ListMeta}
+	for _, ing := range il.Items {
+		if class := converted.Class(ing); ours(class) {
+			res.Items = append(res.Items, ing)
+		} else {
+			log.Debugf("Ingress %s/%s has class %q, skipping it", ing.Namespace, ing.Name, class)
+		}
+	}
+	return res
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+func classedIngress(name string, class string) v1beta1.Ingress {
+	ing := v1beta1.Ingress{ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "ns1"}}
+	if class != "" {
+		ing.Annotations = map[string]string{INGRESSCLASSANNOTATION: class}
+	}
+	return ing
+}
+
+func TestClassFilter(t *testing.T) {
+	ours := NetworkingIngressClass{ObjectMeta: v1.ObjectMeta{Name: "internal"},
+		Spec: NetworkingIngressClassSpec{Controller: "omio.com/ingressify"}}
+	cloud := NetworkingIngressClass{ObjectMeta: v1.ObjectMeta{Name: "gce"},
+		Spec: NetworkingIngressClassSpec{Controller: "k8s.io/ingress-gce"}}
+	defaultOurs := ours
+	defaultOurs.Annotations = map[string]string{DEFAULTCLASSANNOTATION: "true"}
+	defaultCloud := cloud
+	defaultCloud.Annotations = map[string]string{DEFAULTCLASSANNOTATION: "true"}
+	cases := []struct {
+		scope    Scope
+		classes  []NetworkingIngressClass
+		expected map[string]bool
+	}{
+		{Scope{}, nil, map[string]bool{"": true, "ingressify": true, "gce": true}},
+		{Scope{IngressClass: "ingressify"}, nil, map[string]bool{"": false, "ingressify": true, "gce": false}},
+		{Scope{IngressClass: "ingressify", ClaimUnclassed: true}, nil, map[string]bool{"": true, "ingressify": true, "gce": false}},
+		{Scope{IngressController: "omio.com/ingressify"}, []NetworkingIngressClass{ours, cloud},
+			map[string]bool{"": false, "internal": true, "gce": false}},
+		{Scope{IngressController: "omio.com/ingressify"}, []NetworkingIngressClass{defaultOurs, cloud},
+			map[string]bool{"": true, "internal": true, "gce": false}},
+		{Scope{IngressClass: "ingressify", ClaimUnclassed: true}, []NetworkingIngressClass{defaultCloud},
+			map[string]bool{"": false, "ingressify": true, "gce": false}},
+	}
+	for _, c := range cases {
+		filter := c.scope.ClassFilter(c.classes)
+		for class, expected := range c.expected {
+			if got := filter(class); got != expected {
+				t.Errorf("Wrong claim for class %q with %+v, got: %t, expected: %t", class, c.scope, got, expected)
+			}
+		}
+	}
+}
+
+func TestFilterIngressClass(t *testing.T) {
+	il := &v1beta1.IngressList{Items: []v1beta1.Ingress{
+		classedIngress("a", "ingressify"), classedIngress("b", "gce"), classedIngress("c", "")}}
+	// d only has a spec.ingressClassName
+	il.Items = append(il.Items, classedIngress("d", ""))
+	converted := Converted{"ns1/d": {ClassName: "ingressify"}}
+	res := FilterIngressClass(il, converted, Scope{IngressClass: "ingressify", ClaimUnclassed: true}.ClassFilter(nil))
+	if len(res.Items) != 3 || res.Items[0].Name != "a" || res.Items[1].Name != "c" || res.Items[2].Name != "d" {
+		t.Errorf("Wrong ingresses kept, got: %v, expected: [a c d]", res.Items)
+	}
+	if res = FilterIngressClass(il, converted, Scope{IngressClass: "ingressify"}.ClassFilter(nil)); len(res.Items) != 2 {
+		t.Errorf("Wrong ingresses kept, got: %v, expected: [a d]", res.Items)
+	}
+}
+
+func TestNeedsClasses(t *testing.T) {
+	classed := &v1beta1.IngressList{Items: []v1beta1.Ingress{classedIngress("a", "ingressify")}}
+	unclassed := &v1beta1.IngressList{Items: []v1beta1.Ingress{classedIngress("a", "ingressify"), classedIngress("b", "")}}
+	if (Scope{IngressClass: "ingressify"}).needsClasses(classed, nil) {
+		t.Errorf("IngressClasses should not be listed when every ingress has a class and no controller is set")
+	}
+	if !(Scope{IngressClass: "ingressify"}).needsClasses(unclassed, nil) {
+		t.Errorf("IngressClasses should be listed to find the default class of unclassed ingresses")
+	}
+	if (Scope{IngressClass: "ingressify"}).needsClasses(unclassed, Converted{"ns1/b": {ClassName: "ingressify"}}) {
+		t.Errorf("spec.ingressClassName should count as a class")
+	}
+	if !(Scope{IngressController: "omio.com/ingressify"}).needsClasses(classed, nil) {
+		t.Errorf("IngressClasses should be listed to find the classes of the controller")
+	}
+}
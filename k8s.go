@@ -2,14 +2,50 @@ package main
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/apex/log"
 	"k8s.io/client-go/kubernetes"
+	apierrors "k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/meta"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/pkg/watch"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// WATCHRETRYINTERVAL is the time to wait before re-establishing a failed watch
+const WATCHRETRYINTERVAL = 5 * time.Second
+
+// referencedServices are the services referenced by the rules of the last built context, the watches of resources
+// named after services only signal changes to those
+var referencedServices = &keySet{}
+
+// keySet is a set of namespace/name keys safe for concurrent use
+type keySet struct {
+	sync.RWMutex
+	keys map[string]bool
+}
+
+// SetServices replaces the keys with the ones of the services referenced by `rules`
+func (s *keySet) SetServices(rules []IngressifyRule) {
+	keys := make(map[string]bool)
+	for _, rule := range rules {
+		keys[ServiceKey(rule.Namespace, rule.ServiceName)] = true
+	}
+	s.Lock()
+	s.keys = keys
+	s.Unlock()
+}
+
+// Has reports whether `key` is in the set
+func (s *keySet) Has(key string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.keys[key]
+}
+
 // GetKubeClient creates a k8s client
 func GetKubeClient(configfile string) (*kubernetes.Clientset, error) {
 	kubeconfig, err := clientcmd.BuildConfigFromFlags("", configfile)
@@ -25,18 +61,257 @@ func GetKubeClient(configfile string) (*kubernetes.Clientset, error) {
 
 // ScrapeIngresses connects to k8s and retrieves ingresses rules for all the namespaces
 func ScrapeIngresses(client kubernetes.Interface, namespace string) (*v1beta1.IngressList, error) {
+	return ScrapeIngressesMatching(client, namespace, "")
+}
+
+// ScrapeIngressesMatching retrieves the ingresses rules on `namespace` matching the label `selector`
+func ScrapeIngressesMatching(client kubernetes.Interface, namespace string, selector string) (*v1beta1.IngressList, error) {
 	var nslog string
 	if namespace == "" {
 		nslog = "Fetching Ingress rules on all namespaces"
 	} else {
 		nslog = fmt.Sprintf("Fetching Ingress rules on namespace = %s", namespace)
 	}
+	if selector != "" {
+		nslog = fmt.Sprintf("%s matching %s", nslog, selector)
+	}
 	log.Infof(nslog)
 	ingressClient := client.ExtensionsV1beta1().Ingresses(namespace)
-	list, err := ingressClient.List(v1.ListOptions{})
+	list, err := ingressClient.List(v1.ListOptions{LabelSelector: selector})
 	if err != nil {
 		log.WithError(err).Error("Failed to get list of ingresses rules")
 		return nil, err
 	}
 	return list, nil
 }
+
+// ScrapeNamespaces retrieves the names of the namespaces matching the label `selector`
+func ScrapeNamespaces(client kubernetes.Interface, selector string) (map[string]bool, error) {
+	list, err := client.CoreV1().Namespaces().List(v1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		log.WithError(err).Error("Failed to get list of namespaces")
+		return nil, err
+	}
+	namespaces := make(map[string]bool)
+	for _, ns := range list.Items {
+		namespaces[ns.Name] = true
+	}
+	return namespaces, nil
+}
+
+// ScrapeServices retrieves the Services referenced by `rules`, keyed by namespace/name. They are listed once per
+// namespace of `rules`, services that don't exist are skipped. Namespaces whose services ingressify is not allowed
+// to list are returned aside with the error, so that only their rules fail.
+func ScrapeServices(client kubernetes.Interface, rules []IngressifyRule) (map[string]v1.Service, map[string]error, error) {
+	wanted := make(map[string]map[string]bool)
+	for _, rule := range rules {
+		if wanted[rule.Namespace] == nil {
+			wanted[rule.Namespace] = make(map[string]bool)
+		}
+		wanted[rule.Namespace][rule.ServiceName] = true
+	}
+	services := make(map[string]v1.Service)
+	unlisted := make(map[string]error)
+	for namespace, names := range wanted {
+		list, err := client.CoreV1().Services(namespace).List(v1.ListOptions{})
+		if apierrors.IsForbidden(err) {
+			log.WithError(err).Warnf("Not allowed to list services on namespace %s", namespace)
+			unlisted[namespace] = err
+			continue
+		}
+		if err != nil {
+			log.WithError(err).Errorf("Failed to get list of services on namespace %s", namespace)
+			return nil, nil, err
+		}
+		for _, svc := range list.Items {
+			if names[svc.Name] {
+				services[ServiceKey(namespace, svc.Name)] = svc
+			}
+		}
+		for name := range names {
+			if _, ok := services[ServiceKey(namespace, name)]; !ok {
+				log.Warnf("Service %s referenced by ingress rules not found", ServiceKey(namespace, name))
+			}
+		}
+	}
+	return services, unlisted, nil
+}
+
+// ScrapeEndpoints retrieves the Endpoints of the services referenced by `rules`, keyed by namespace/name.
+// They are listed once per namespace of `rules`, services without Endpoints and namespaces whose endpoints
+// ingressify is not allowed to list are skipped.
+// EndpointSlices are not read, the endpoints controller keeps maintaining the Endpoints of every service.
+func ScrapeEndpoints(client kubernetes.Interface, rules []IngressifyRule) (map[string]v1.Endpoints, error) {
+	wanted := make(map[string]map[string]bool)
+	for _, rule := range rules {
+		if wanted[rule.Namespace] == nil {
+			wanted[rule.Namespace] = make(map[string]bool)
+		}
+		wanted[rule.Namespace][rule.ServiceName] = true
+	}
+	endpoints := make(map[string]v1.Endpoints)
+	for namespace, names := range wanted {
+		list, err := client.CoreV1().Endpoints(namespace).List(v1.ListOptions{})
+		if apierrors.IsForbidden(err) {
+			log.WithError(err).Warnf("Not allowed to list endpoints on namespace %s, skipping them", namespace)
+			continue
+		}
+		if err != nil {
+			log.WithError(err).Errorf("Failed to get list of endpoints on namespace %s", namespace)
+			return nil, err
+		}
+		for _, eps := range list.Items {
+			if names[eps.Name] {
+				endpoints[ServiceKey(namespace, eps.Name)] = eps
+			}
+		}
+		for name := range names {
+			if _, ok := endpoints[ServiceKey(namespace, name)]; !ok {
+				log.Warnf("Endpoints for service %s not found", ServiceKey(namespace, name))
+			}
+		}
+	}
+	return endpoints, nil
+}
+
+// ScrapeSecrets retrieves the Secrets of the TLS sections covering `rules`, keyed by namespace/name.
+// Secrets that don't exist, aren't of type kubernetes.io/tls or can't be read are skipped, so that a namespace whose
+// secrets ingressify is not allowed to get doesn't fail the cycle; the hosts of skipped secrets keep their current
+// certificate, see StageCertificates.
+func ScrapeSecrets(client kubernetes.Interface, rules []IngressifyRule) map[string]v1.Secret {
+	secrets := make(map[string]v1.Secret)
+	seen := make(map[string]bool)
+	forbidden := make(map[string]bool)
+	for _, rule := range rules {
+		if rule.TLSSecret == "" || forbidden[rule.Namespace] {
+			continue
+		}
+		key := ServiceKey(rule.Namespace, rule.TLSSecret)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		secret, err := client.CoreV1().Secrets(rule.Namespace).Get(rule.TLSSecret)
+		if apierrors.IsNotFound(err) {
+			log.Warnf("Secret %s referenced by ingress %s/%s not found", key, rule.Namespace, rule.Name)
+			continue
+		}
+		if apierrors.IsForbidden(err) {
+			log.WithError(err).Warnf("Not allowed to get secrets on namespace %s, skipping them", rule.Namespace)
+			forbidden[rule.Namespace] = true
+			continue
+		}
+		if err != nil {
+			log.WithError(err).Errorf("Failed to get secret %s, skipping it", key)
+			continue
+		}
+		if secret.Type != v1.SecretTypeTLS {
+			log.Warnf("Secret %s referenced by ingress %s/%s is of type %s, skipping it", key, rule.Namespace, rule.Name, secret.Type)
+			continue
+		}
+		secrets[key] = *secret
+	}
+	return secrets
+}
+
+// WatchIngresses watches ingresses on `namespace` matching the label `selector`
+// and signals `events` on every add, update or delete.
+// The watch is re-established whenever the server closes it or fails. It returns once `stop` is closed.
+func WatchIngresses(client kubernetes.Interface, namespace string, selector string, events chan<- struct{}, stop <-chan struct{}) {
+	watchResource("ingresses", func(opts v1.ListOptions) (watch.Interface, error) {
+		opts.LabelSelector = selector
+		return client.ExtensionsV1beta1().Ingresses(namespace).Watch(opts)
+	}, nil, events, stop)
+}
+
+// WatchNamespaces watches namespaces matching the label `selector`, it behaves like WatchIngresses
+func WatchNamespaces(client kubernetes.Interface, selector string, events chan<- struct{}, stop <-chan struct{}) {
+	watchResource("namespaces", func(opts v1.ListOptions) (watch.Interface, error) {
+		opts.LabelSelector = selector
+		return client.CoreV1().Namespaces().Watch(opts)
+	}, nil, events, stop)
+}
+
+// WatchEndpoints watches endpoints on `namespace` and signals `events` on every add, update or delete of the
+// endpoints of a service in `referencedServices`. It behaves like WatchIngresses.
+func WatchEndpoints(client kubernetes.Interface, namespace string, events chan<- struct{}, stop <-chan struct{}) {
+	watchResource("endpoints", func(opts v1.ListOptions) (watch.Interface, error) {
+		return client.CoreV1().Endpoints(namespace).Watch(opts)
+	}, referencedServices.Has, events, stop)
+}
+
+// WatchServices watches services on `namespace` and signals `events` on every add, update or delete of a service
+// in `referencedServices`. It behaves like WatchIngresses.
+func WatchServices(client kubernetes.Interface, namespace string, events chan<- struct{}, stop <-chan struct{}) {
+	watchResource("services", func(opts v1.ListOptions) (watch.Interface, error) {
+		return client.CoreV1().Services(namespace).Watch(opts)
+	}, referencedServices.Has, events, stop)
+}
+
+// WatchSecrets watches TLS secrets on `namespace`, it behaves like WatchIngresses
+func WatchSecrets(client kubernetes.Interface, namespace string, events chan<- struct{}, stop <-chan struct{}) {
+	watchResource("secrets", func(opts v1.ListOptions) (watch.Interface, error) {
+		opts.FieldSelector = "type=" + string(v1.SecretTypeTLS)
+		return client.CoreV1().Secrets(namespace).Watch(opts)
+	}, nil, events, stop)
+}
+
+// watchResource watches with `watchFunc` until `stop` is closed. Only the objects whose namespace/name key passes
+// `filter` signal `events`, all of them when `filter` is nil.
+func watchResource(resource string, watchFunc func(v1.ListOptions) (watch.Interface, error), filter func(string) bool,
+	events chan<- struct{}, stop <-chan struct{}) {
+	var resourceVersion string
+	for {
+		w, err := watchFunc(v1.ListOptions{ResourceVersion: resourceVersion})
+		if err != nil {
+			log.WithError(err).Errorf("Failed to watch %s, retrying", resource)
+			resourceVersion = ""
+			select {
+			case <-stop:
+				return
+			case <-time.After(WATCHRETRYINTERVAL):
+			}
+			continue
+		}
+		var stopped bool
+		resourceVersion, stopped = consumeWatch(w, resourceVersion, filter, events, stop)
+		if stopped {
+			return
+		}
+		log.Infof("Watch on %s closed, re-establishing it", resource)
+	}
+}
+
+// consumeWatch forwards the events of `w` passing `filter` until it gets closed, returning the last seen resource version
+func consumeWatch(w watch.Interface, resourceVersion string, filter func(string) bool, events chan<- struct{},
+	stop <-chan struct{}) (string, bool) {
+	defer w.Stop()
+	for {
+		select {
+		case <-stop:
+			return resourceVersion, true
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return resourceVersion, false
+			}
+			switch event.Type {
+			case watch.Error:
+				// most likely the resource version is too old, start over from the current state
+				log.Warn("Watch returned an error, restarting it")
+				return "", false
+			case watch.Added, watch.Modified, watch.Deleted:
+				obj, err := meta.Accessor(event.Object)
+				if err == nil {
+					resourceVersion = obj.GetResourceVersion()
+				}
+				if filter != nil && (err != nil || !filter(ServiceKey(obj.GetNamespace(), obj.GetName()))) {
+					continue
+				}
+				select {
+				case events <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
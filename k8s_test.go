@@ -1,8 +1,18 @@
 package main
 
 import (
-	"k8s.io/client-go/kubernetes/fake"
+	"errors"
 	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+	apierrors "k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/unversioned"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/pkg/runtime"
+	"k8s.io/client-go/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestScrapeIngressesForAllNamespaces(t *testing.T) {
@@ -30,3 +40,170 @@ func TestScrapeIngressesForAGivenNamespace(t *testing.T) {
 		t.Errorf("Didn't scrape all rules, got: %d, expected: %d ", irules.Size(), 2)
 	}
 }
+
+func TestWatchIngressesSignalsChanges(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	watcher := watch.NewFake()
+	client.PrependWatchReactor("ingresses", k8stesting.DefaultWatchReactor(watcher, nil))
+	events := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go WatchIngresses(client, "", "", events, stop)
+	watcher.Add(&v1beta1.Ingress{})
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Errorf("Expected an event after an ingress was added")
+	}
+}
+
+func TestScrapeEndpointsSkipsMissingServices(t *testing.T) {
+	eps := v1.Endpoints{ObjectMeta: v1.ObjectMeta{Name: "svc1", Namespace: "ns1"}}
+	other := v1.Endpoints{ObjectMeta: v1.ObjectMeta{Name: "svc1", Namespace: "ns2"}}
+	client := fake.NewSimpleClientset(&eps, &other)
+	rules := []IngressifyRule{
+		{Namespace: "ns1", ServiceName: "svc1"},
+		{Namespace: "ns1", ServiceName: "svc1"},
+		{Namespace: "ns1", ServiceName: "missing"},
+	}
+	endpoints, err := ScrapeEndpoints(client, rules)
+	if err != nil {
+		t.Errorf("Something went wrong scraping endpoints: %s\n", err)
+		return
+	}
+	if len(endpoints) != 1 {
+		t.Errorf("Wrong number of endpoints, got: %d, expected: %d", len(endpoints), 1)
+	}
+	if _, ok := endpoints["ns1/svc1"]; !ok {
+		t.Errorf("Endpoints for ns1/svc1 are missing")
+	}
+}
+
+func TestScrapeEndpointsToleratesForbiddenNamespaces(t *testing.T) {
+	eps := v1.Endpoints{ObjectMeta: v1.ObjectMeta{Name: "svc1", Namespace: "ns1"}}
+	client := fake.NewSimpleClientset(&eps)
+	client.PrependReactor("list", "endpoints", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() != "ns2" {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewForbidden(unversioned.GroupResource{Resource: "endpoints"}, "", errors.New("denied"))
+	})
+	rules := []IngressifyRule{
+		{Namespace: "ns1", ServiceName: "svc1"},
+		{Namespace: "ns2", ServiceName: "svc1"},
+	}
+	endpoints, err := ScrapeEndpoints(client, rules)
+	if err != nil {
+		t.Fatalf("Forbidden namespaces should not fail the scrape, got: %s", err)
+	}
+	if _, ok := endpoints["ns1/svc1"]; !ok || len(endpoints) != 1 {
+		t.Errorf("Expected only endpoints ns1/svc1, got: %v", endpoints)
+	}
+}
+
+func TestWatchEndpointsOnlySignalsReferencedServices(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	watcher := watch.NewFake()
+	client.PrependWatchReactor("endpoints", k8stesting.DefaultWatchReactor(watcher, nil))
+	referencedServices.SetServices([]IngressifyRule{{Namespace: "ns1", ServiceName: "svc1"}})
+	defer referencedServices.SetServices(nil)
+	events := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go WatchEndpoints(client, "", events, stop)
+	watcher.Modify(&v1.Endpoints{ObjectMeta: v1.ObjectMeta{Name: "kube-scheduler", Namespace: "kube-system"}})
+	select {
+	case <-events:
+		t.Errorf("Endpoints of an unreferenced service should not signal a change")
+	case <-time.After(100 * time.Millisecond):
+	}
+	watcher.Modify(&v1.Endpoints{ObjectMeta: v1.ObjectMeta{Name: "svc1", Namespace: "ns1"}})
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Errorf("Expected an event after the endpoints of a referenced service changed")
+	}
+}
+
+func TestScrapeServicesSkipsMissingServices(t *testing.T) {
+	svc := v1.Service{ObjectMeta: v1.ObjectMeta{Name: "svc1", Namespace: "ns1"}}
+	client := fake.NewSimpleClientset(&svc)
+	rules := []IngressifyRule{
+		{Namespace: "ns1", ServiceName: "svc1"},
+		{Namespace: "ns2", ServiceName: "svc1"},
+	}
+	services, unlisted, err := ScrapeServices(client, rules)
+	if err != nil || len(unlisted) != 0 {
+		t.Errorf("Something went wrong scraping services: %s\n", err)
+		return
+	}
+	if _, ok := services["ns1/svc1"]; !ok || len(services) != 1 {
+		t.Errorf("Expected only service ns1/svc1, got: %v", services)
+	}
+}
+
+func TestScrapeServicesToleratesForbiddenNamespaces(t *testing.T) {
+	svc := v1.Service{ObjectMeta: v1.ObjectMeta{Name: "svc1", Namespace: "ns1"}}
+	client := fake.NewSimpleClientset(&svc)
+	client.PrependReactor("list", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() != "ns2" {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewForbidden(unversioned.GroupResource{Resource: "services"}, "", errors.New("denied"))
+	})
+	rules := []IngressifyRule{
+		{Namespace: "ns1", ServiceName: "svc1"},
+		{Namespace: "ns2", ServiceName: "svc1"},
+	}
+	services, unlisted, err := ScrapeServices(client, rules)
+	if err != nil {
+		t.Fatalf("Forbidden namespaces should not fail the scrape, got: %s", err)
+	}
+	if _, ok := services["ns1/svc1"]; !ok || len(services) != 1 {
+		t.Errorf("Expected only service ns1/svc1, got: %v", services)
+	}
+	if _, ok := unlisted["ns2"]; !ok || len(unlisted) != 1 {
+		t.Errorf("Expected namespace ns2 to be unlisted, got: %v", unlisted)
+	}
+}
+
+func TestScrapeSecretsSkipsNonTLSSecrets(t *testing.T) {
+	cert := v1.Secret{ObjectMeta: v1.ObjectMeta{Name: "cert", Namespace: "ns1"}, Type: v1.SecretTypeTLS}
+	opaque := v1.Secret{ObjectMeta: v1.ObjectMeta{Name: "opaque", Namespace: "ns1"}, Type: v1.SecretTypeOpaque}
+	client := fake.NewSimpleClientset(&cert, &opaque)
+	rules := []IngressifyRule{
+		{Namespace: "ns1", TLSSecret: "cert"},
+		{Namespace: "ns1", TLSSecret: "opaque"},
+		{Namespace: "ns1", TLSSecret: "missing"},
+		{Namespace: "ns1"},
+	}
+	secrets := ScrapeSecrets(client, rules)
+	if _, ok := secrets["ns1/cert"]; !ok || len(secrets) != 1 {
+		t.Errorf("Expected only secret ns1/cert, got: %v", secrets)
+	}
+}
+
+func TestScrapeSecretsToleratesForbiddenNamespaces(t *testing.T) {
+	cert := v1.Secret{ObjectMeta: v1.ObjectMeta{Name: "cert", Namespace: "ns1"}, Type: v1.SecretTypeTLS}
+	client := fake.NewSimpleClientset(&cert)
+	var denied int
+	client.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() != "ns2" {
+			return false, nil, nil
+		}
+		denied++
+		return true, nil, apierrors.NewForbidden(unversioned.GroupResource{Resource: "secrets"}, "", errors.New("denied"))
+	})
+	rules := []IngressifyRule{
+		{Namespace: "ns1", TLSSecret: "cert"},
+		{Namespace: "ns2", TLSSecret: "cert"},
+		{Namespace: "ns2", TLSSecret: "other"},
+	}
+	secrets := ScrapeSecrets(client, rules)
+	if _, ok := secrets["ns1/cert"]; !ok || len(secrets) != 1 {
+		t.Errorf("Expected only secret ns1/cert, got: %v", secrets)
+	}
+	if denied != 1 {
+		t.Errorf("Forbidden namespace should be skipped after the first denial, got: %d calls", denied)
+	}
+}
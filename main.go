@@ -1,21 +1,38 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"html/template"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/Masterminds/sprig"
 	"github.com/apex/log"
 	"github.com/pkg/errors"
-	"k8s.io/client-go/kubernetes"
 )
 
+// SHUTDOWNGRACEPERIOD is how long the running cycle and its hooks are given to finish on shutdown, unless configured
+// otherwise
+const SHUTDOWNGRACEPERIOD = 30 * time.Second
+
+// SHUTDOWNKILLWAIT is how long the cycle is waited for once its hooks were killed at the end of the grace period
+const SHUTDOWNKILLWAIT = 5 * time.Second
+
 func main() {
+	os.Exit(run())
+}
+
+// run runs ingressify until it is stopped by SIGTERM or SIGINT and returns the exit code: 0 when it shut down
+// cleanly, 1 when it failed or the running cycle didn't finish within the grace period, 128 + the signal number
+// when a second signal forced it to stop.
+func run() int {
 	data, err := Asset("gen/version")
 	if err != nil {
 		log.WithError(err).Error("error")
@@ -31,12 +48,16 @@ func main() {
 	config := ReadConfig(*configPath)
 
 	opsStatus := make(chan *OpsStatus, 10)
-	defer close(opsStatus)
 
 	duration, err := config.getInterval()
 	if err != nil {
 		log.WithError(err).Error("Failed to parse interval")
-		return
+		return 1
+	}
+	grace, err := config.getGracePeriod()
+	if err != nil {
+		log.WithError(err).Error("Failed to parse shutdown grace period")
+		return 1
 	}
 
 	fmap := template.FuncMap{
@@ -44,6 +65,10 @@ func main() {
 		"GroupByPath":    GroupByPath,
 		"GroupBySvcNs":   GroupBySvcNs,
 		"OrderByPathLen": OrderByPathLen,
+		"SortedKeys":     SortedKeys,
+		"PathRegex":      PathRegex,
+		"NginxLocation":  NginxLocation,
+		"HAProxyPathACL": HAProxyPathACL,
 		"AsMap":          AsMap,
 		"AsSlice":        AsSlice,
 	}
@@ -51,47 +76,158 @@ func main() {
 	clientset, err := GetKubeClient(config.Kubeconfig)
 	if err != nil {
 		log.WithError(err).Error("Failed to build k8s client")
-		return
+		return 1
 	}
 
-	tmpl, err := PrepareTemplate(config.InTemplate, BuildFuncMap(fmap, sprig.FuncMap()))
+	config.IngressAPIVersion, err = ResolveIngressAPIVersion(clientset, config.IngressAPIVersion)
+	if err != nil {
+		log.WithError(err).Error("Failed to resolve ingress API version")
+		return 1
+	}
+	log.Infof("Using ingress API version %s", config.IngressAPIVersion)
+
+	annotations := Annotations{Prefix: config.AnnotationPrefix}
+	funcs := BuildFuncMap(fmap, annotations.FuncMap(), Query{Annotations: annotations}.FuncMap(), sprig.FuncMap())
+	outputs, err := PrepareOutputs(config.getTemplates(), funcs)
 	if err != nil {
 		log.WithError(err).Error("Failed to prepare template")
-		return
+		return 1
+	}
+	if err = config.Hooks.Prepare(funcs); err != nil {
+		log.WithError(err).Error("Failed to prepare hooks")
+		return 1
 	}
 
 	if *dryRun {
-		err = render(config.OutTemplate, clientset, tmpl)
+		var pendings, certs []*PendingOutput
+		pendings, certs, _, err = render(config, clientset, outputs)
+		if err == nil {
+			if len(certs) > 0 {
+				log.Infof("Dry run, not writing the %d certificate changes", len(certs))
+			}
+			discardAll(certs)
+			err = commitAll(pendings)
+		}
 		if err != nil {
 			log.WithError(err).Error("Failed to render template")
-			panic(err)
+			return 1
 		}
-	} else {
-		go func() {
-			for range time.NewTicker(duration).C {
-				err = render(config.OutTemplate, clientset, tmpl)
-				if err != nil {
-					log.WithError(err).Error("Failed to render template")
-					opsStatus <- &OpsStatus{isSuccess: false, timestamp: time.Now(), error: err}
-					continue //we don't bother to exec hooks since the rendering failed
-				}
-				err = execHooks(config, opsStatus)
-				if err != nil {
-					opsStatus <- &OpsStatus{isSuccess: false, timestamp: time.Now(), error: err}
-					continue
-				}
-				opsStatus <- &OpsStatus{isSuccess: true, timestamp: time.Now()}
+		return 0
+	}
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	server := newHealthCheckServer(opsStatus, duration, config.HealthCheckPort)
+	return serve(func(ctx context.Context, stopHooks <-chan struct{}) {
+		events := make(chan struct{}, 1)
+		watchChanges(config, clientset, events, ctx.Done())
+		triggers := Debounce(events, DEBOUNCEINTERVAL)
+		resync := time.NewTicker(duration)
+		defer resync.Stop()
+		var cycleID uint64
+		trigger := "startup"
+		for ctx.Err() == nil {
+			cycleID++
+			cycle := Cycle{ID: cycleID, Trigger: trigger, OutFiles: outFiles(outputs), Timestamp: time.Now(), Stop: stopHooks}
+			runCycle(ctx, config, clientset, outputs, cycle, opsStatus)
+			select {
+			case <-triggers:
+				trigger = "watch"
+			case <-resync.C:
+				trigger = "resync"
+			case <-ctx.Done():
+				return
 			}
-		}()
-		log.WithError(runHealthCheckServer(opsStatus, duration, config.HealthCheckPort)).Error("Health server is down...")
+			log.Infof("Starting render cycle, trigger: %s", trigger)
+		}
+	}, server, sigs, grace)
+}
+
+// drainableServer is the health server as seen by serve
+type drainableServer interface {
+	ListenAndServe() error
+	Shutdown(ctx context.Context) error
+}
+
+// serve runs `loop` and `server` until a signal is received on `sigs` or the server fails. The context of `loop` is
+// then canceled, it is given `grace` to return before `stopHooks` is closed to kill its hooks, and the server is
+// drained. It returns the exit code documented on run.
+func serve(loop func(ctx context.Context, stopHooks <-chan struct{}), server drainableServer, sigs <-chan os.Signal,
+	grace time.Duration) int {
+	ctx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+	stopHooks := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		loop(ctx, stopHooks)
+	}()
+	// hooks still running at the end of the grace period are killed
+	go func() {
+		<-ctx.Done()
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			close(stopHooks)
+		case <-done:
+		}
+	}()
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- server.ListenAndServe() }()
+
+	code := 0
+	select {
+	case err := <-serverErr:
+		log.WithError(err).Error("Health server is down...")
+		code = 1
+	case sig := <-sigs:
+		log.Infof("Received %s, shutting down", sig)
+	}
+	shutdown()
+
+	select {
+	case <-done:
+	case sig := <-sigs:
+		return forcedExit(sig)
+	case <-stopHooks:
+		log.Warnf("Render cycle didn't finish within %s, its hooks were killed", grace)
+		code = 1
+		select {
+		case <-done:
+		case sig := <-sigs:
+			return forcedExit(sig)
+		case <-time.After(SHUTDOWNKILLWAIT):
+			log.Error("Render cycle is stuck, exiting anyway")
+		}
+	}
+	drain, cancel := context.WithTimeout(context.Background(), SHUTDOWNKILLWAIT)
+	defer cancel()
+	if err := server.Shutdown(drain); err != nil {
+		log.WithError(err).Error("Failed to drain health server")
+		code = 1
+	}
+	log.Info("Shut down")
+	return code
+}
+
+// forcedExit returns the exit code when `sig` was received again during the shutdown
+func forcedExit(sig os.Signal) int {
+	log.Errorf("Received %s again, exiting now", sig)
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
 	}
+	return 1
 }
 
-func runHealthCheckServer(status chan *OpsStatus, duration time.Duration, port uint32) error {
+// newHealthCheckServer returns the server of the health check and the metrics, it can be drained with Shutdown
+func newHealthCheckServer(status chan *OpsStatus, duration time.Duration, port uint32) *http.Server {
 	lastReport := OpsStatus{isSuccess: true, timestamp: time.Now()}
-	healthHandler := healthHandler{opsStatus: status, cacheExpirationTime: duration, lastReport: &lastReport}
-	http.HandleFunc("/health", healthHandler.ServeHTTP)
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	healthHandler := &healthHandler{opsStatus: status, cacheExpirationTime: duration, lastReport: &lastReport}
+	mux := http.NewServeMux()
+	mux.Handle("/health", healthHandler)
+	mux.Handle("/metrics", metrics)
+	return &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
 }
 
 type healthHandler struct {
@@ -105,6 +241,7 @@ func (hh *healthHandler) ServeHTTP(writer http.ResponseWriter, request *http.Req
 	hh.Lock()
 	select {
 	case currentReport := <-hh.opsStatus:
+		currentReport = latestReport(currentReport, hh.opsStatus)
 		*hh.lastReport = *currentReport
 		createHealthResponse(*currentReport, writer)
 	default:
@@ -118,45 +255,42 @@ func (hh *healthHandler) ServeHTTP(writer http.ResponseWriter, request *http.Req
 	hh.Unlock()
 }
 
+// latestReport returns the last report pending in `opsStatus`, `last` when there is none
+func latestReport(last *OpsStatus, opsStatus chan *OpsStatus) *OpsStatus {
+	for {
+		select {
+		case last = <-opsStatus:
+		default:
+			return last
+		}
+	}
+}
+
 func createHealthResponse(lastReport OpsStatus, writer http.ResponseWriter) {
-	if lastReport.isSuccess {
+	if lastReport.isSuccess && lastReport.unchanged {
+		writer.WriteHeader(http.StatusOK)
+		fmt.Fprint(writer, "Healthy, output unchanged !\n")
+	} else if lastReport.isSuccess {
 		writer.WriteHeader(http.StatusOK)
 		fmt.Fprint(writer, "Healthy !\n")
 	} else {
 		writer.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(writer, "Unhealthy: %s !\n", lastReport.error)
+		for _, res := range lastReport.hooks {
+			if res.ExitCode != 0 && res.Stderr != "" {
+				fmt.Fprintf(writer, "Error output of %s:\n%s\n", strings.Join(res.Command, " "), res.Stderr)
+			}
+		}
 	}
 }
 
 // OpsStatus holds information to track failures/success of render and execHooks functions
-// this information gets bubbled up to the health check.
+// this information gets bubbled up to the health check. `unchanged` marks successful cycles that didn't change the output,
+// `hooks` holds the results of the hooks run during the cycle.
 type OpsStatus struct {
 	isSuccess bool
+	unchanged bool
 	error     error
 	timestamp time.Time
-}
-
-func execHooks(config Config, renderReport chan<- *OpsStatus) error {
-	log.Info("Running post hook")
-	out, err := ExecHook(config.Hooks.PostRender)
-	if err != nil {
-		log.WithError(err).Error("Failed to run post hook")
-		return err
-	}
-	log.Info("Output from post hook")
-	fmt.Println(out)
-	return nil
-}
-
-func render(outPath string, clientset *kubernetes.Clientset, tmpl *template.Template) error {
-	irules, err := ScrapeIngresses(clientset, "")
-	if err != nil {
-		return err
-	}
-	cxt := ICxt{IngRules: ToIngressifyRule(irules)}
-	err = RenderTemplate(tmpl, outPath, cxt)
-	if err != nil {
-		return err
-	}
-	return nil
+	hooks     []HookResult
 }
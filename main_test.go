@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"syscall"
 	"testing"
 	"time"
 
@@ -62,6 +65,22 @@ func TestBootstrapHealthCheck_should_not_return_cache_when_reporting_ops(t *test
 	}
 }
 
+func TestBootstrapHealthCheck_should_show_error_output_of_failed_hooks(t *testing.T) {
+	hhandler := handlerBuilder()
+	hooks := []HookResult{
+		{Command: []string{"true"}, Stderr: "warning"},
+		{Command: []string{"haproxy", "-c"}, Stderr: "parsing error", ExitCode: 1},
+	}
+	hhandler.opsStatus <- &OpsStatus{isSuccess: false, timestamp: time.Now(), error: errors.New("failed"), hooks: hooks}
+	r, _ := http.NewRequest("GET", "/health", nil)
+	w := httptest.NewRecorder()
+	hhandler.ServeHTTP(w, r)
+	expectedBody := "Unhealthy: failed !\nError output of haproxy -c:\nparsing error\n"
+	if w.Body.String() != expectedBody {
+		t.Errorf("Body is wrong, got: %s, expected: %s", w.Body.String(), expectedBody)
+	}
+}
+
 func TestBootstrapHealthCheck_should_return_last_report_as_cache_when_no_report(t *testing.T) {
 	hhandler := handlerBuilder()
 	statusError := OpsStatus{isSuccess: false, timestamp: time.Now(), error: errors.New("This one failed")}
@@ -126,3 +145,134 @@ func TestBootstrapHealthCheck_should_not_return_cache_after_report_and_cache_exp
 		t.Errorf("Body is wrong, got: %s, expected: %s", string(body), expectedBody)
 	}
 }
+
+func TestBootstrapHealthCheck_should_report_unchanged_cycles(t *testing.T) {
+	hhandler := handlerBuilder()
+	hhandler.opsStatus <- &OpsStatus{isSuccess: true, unchanged: true, timestamp: time.Now()}
+	r, _ := http.NewRequest("GET", "/health", nil)
+	w := httptest.NewRecorder()
+	hhandler.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Errorf("Should return 200 for an unchanged cycle, got: %d, expected %d", w.Code, 200)
+	}
+	body, _ := ioutil.ReadAll(w.Body)
+	if expectedBody := "Healthy, output unchanged !\n"; string(body) != expectedBody {
+		t.Errorf("Body is wrong, got: %s, expected: %s", string(body), expectedBody)
+	}
+}
+
+func TestHealthCheckServerShutdown(t *testing.T) {
+	server := newHealthCheckServer(make(chan *OpsStatus), REFRESHINTERVAL, 0)
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServe() }()
+	time.Sleep(100 * time.Millisecond)
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Errorf("Failed to shut down health server: %s", err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("Health server should be closed, got: %v, expected: %v", err, http.ErrServerClosed)
+	}
+}
+
+func TestReportNeverBlocksAndHealthShowsLatest(t *testing.T) {
+	hhandler := handlerBuilder()
+	for i := 0; i < 25; i++ {
+		report(hhandler.opsStatus, &OpsStatus{isSuccess: false, timestamp: time.Now(), error: fmt.Errorf("failure %d", i)})
+	}
+	report(hhandler.opsStatus, &OpsStatus{isSuccess: true, unchanged: true, timestamp: time.Now()})
+	r, _ := http.NewRequest("GET", "/health", nil)
+	w := httptest.NewRecorder()
+	hhandler.ServeHTTP(w, r)
+	if w.Code != 200 || w.Body.String() != "Healthy, output unchanged !\n" {
+		t.Errorf("Health should show the latest report, got: %d %s", w.Code, w.Body.String())
+	}
+	if len(hhandler.opsStatus) != 0 {
+		t.Errorf("Pending reports should be drained, got: %d", len(hhandler.opsStatus))
+	}
+}
+
+// stubServer stands for the health server in the tests of serve, it runs until it is shut down unless it fails
+type stubServer struct {
+	err       error
+	stopped   chan struct{}
+	shutdowns int
+}
+
+func newStubServer(err error) *stubServer {
+	return &stubServer{err: err, stopped: make(chan struct{})}
+}
+
+func (s *stubServer) ListenAndServe() error {
+	if s.err != nil {
+		return s.err
+	}
+	<-s.stopped
+	return http.ErrServerClosed
+}
+
+func (s *stubServer) Shutdown(ctx context.Context) error {
+	s.shutdowns++
+	close(s.stopped)
+	return nil
+}
+
+func TestServeShutsDownOnSignal(t *testing.T) {
+	server := newStubServer(nil)
+	sigs := make(chan os.Signal, 2)
+	sigs <- syscall.SIGTERM
+	var finished bool
+	var stop <-chan struct{}
+	code := serve(func(ctx context.Context, stopHooks <-chan struct{}) {
+		<-ctx.Done()
+		finished, stop = true, stopHooks
+	}, server, sigs, 10*time.Millisecond)
+	if code != 0 || !finished || server.shutdowns != 1 {
+		t.Errorf("Wrong shutdown, got code: %d, cycle finished: %t, shutdowns: %d", code, finished, server.shutdowns)
+	}
+	select {
+	case <-stop:
+		t.Errorf("Hooks should not be killed once the cycle finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestServeKillsHooksAfterGracePeriod(t *testing.T) {
+	server := newStubServer(nil)
+	sigs := make(chan os.Signal, 2)
+	sigs <- syscall.SIGINT
+	var aborted bool
+	code := serve(func(ctx context.Context, stopHooks <-chan struct{}) {
+		<-stopHooks
+		aborted = true
+	}, server, sigs, 10*time.Millisecond)
+	if code != 1 || !aborted || server.shutdowns != 1 {
+		t.Errorf("Wrong shutdown, got code: %d, cycle aborted: %t, shutdowns: %d", code, aborted, server.shutdowns)
+	}
+}
+
+func TestServeExitsOnSecondSignal(t *testing.T) {
+	server := newStubServer(nil)
+	sigs := make(chan os.Signal, 2)
+	sigs <- syscall.SIGTERM
+	sigs <- syscall.SIGTERM
+	release := make(chan struct{})
+	defer close(release)
+	code := serve(func(ctx context.Context, stopHooks <-chan struct{}) {
+		<-release
+	}, server, sigs, time.Minute)
+	if expected := 128 + int(syscall.SIGTERM); code != expected || server.shutdowns != 0 {
+		t.Errorf("Wrong exit, got code: %d, shutdowns: %d, expected: %d", code, server.shutdowns, expected)
+	}
+}
+
+func TestServeStopsWhenServerFails(t *testing.T) {
+	server := newStubServer(errors.New("address already in use"))
+	var finished bool
+	code := serve(func(ctx context.Context, stopHooks <-chan struct{}) {
+		<-ctx.Done()
+		finished = true
+	}, server, make(chan os.Signal), time.Minute)
+	if code != 1 || !finished || server.shutdowns != 1 {
+		t.Errorf("Wrong shutdown, got code: %d, cycle finished: %t, shutdowns: %d", code, finished, server.shutdowns)
+	}
+}
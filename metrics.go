@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Minimal implementation of the Prometheus text exposition format, it only supports what
+	ingressify exposes: counters, gauges and histograms with labels.
+*/
+
+// DURATIONBUCKETS are the histogram buckets used for durations, in seconds
+var DURATIONBUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metricVec is a counter or a gauge partitioned by labels
+type metricVec struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	values     map[string]float64
+	labels     map[string][]string
+	sync.Mutex
+}
+
+func newMetricVec(kind string, name string, help string, labelNames ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labelNames: labelNames,
+		values: make(map[string]float64), labels: make(map[string][]string)}
+}
+
+// Add adds `v` to the metric with the given label values
+func (m *metricVec) Add(v float64, labelValues ...string) {
+	m.Lock()
+	defer m.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	m.values[key] += v
+	m.labels[key] = labelValues
+}
+
+// Set sets the metric with the given label values to `v`
+func (m *metricVec) Set(v float64, labelValues ...string) {
+	m.Lock()
+	defer m.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	m.values[key] = v
+	m.labels[key] = labelValues
+}
+
+// Reset drops all the label values, used for gauges whose partitions can disappear
+func (m *metricVec) Reset() {
+	m.Lock()
+	defer m.Unlock()
+	m.values = make(map[string]float64)
+	m.labels = make(map[string][]string)
+}
+
+// Get returns the value of the metric with the given label values
+func (m *metricVec) Get(labelValues ...string) float64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.values[strings.Join(labelValues, "\xff")]
+}
+
+func (m *metricVec) writeTo(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labelNames, m.labels[key]), formatValue(m.values[key]))
+	}
+}
+
+// histogramVec is a histogram partitioned by labels
+type histogramVec struct {
+	name       string
+	help       string
+	buckets    []float64
+	labelNames []string
+	counts     map[string][]uint64
+	sums       map[string]float64
+	totals     map[string]uint64
+	labels     map[string][]string
+	sync.Mutex
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labelNames ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, labelNames: labelNames,
+		counts: make(map[string][]uint64), sums: make(map[string]float64),
+		totals: make(map[string]uint64), labels: make(map[string][]string)}
+}
+
+// Observe records `v` in the histogram with the given label values
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	if _, ok := h.counts[key]; !ok {
+		h.counts[key] = make([]uint64, len(h.buckets))
+		h.labels[key] = labelValues
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[key][i]++
+		}
+	}
+	h.sums[key] += v
+	h.totals[key]++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	names := withLabel(h.labelNames, "le")
+	for _, key := range sortedKeys(h.sums) {
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, withLabel(h.labels[key], formatValue(bound))), h.counts[key][i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, withLabel(h.labels[key], "+Inf")), h.totals[key])
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labelNames, h.labels[key]), formatValue(h.sums[key]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labelNames, h.labels[key]), h.totals[key])
+	}
+}
+
+// withLabel returns a copy of `labels` with `label` appended
+func withLabel(labels []string, label string) []string {
+	return append(append([]string{}, labels...), label)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Metrics holds everything exposed on /metrics
+type Metrics struct {
+	RenderDuration      *histogramVec
+	RenderFailures      *metricVec
+	HookDuration        *histogramVec
+	HookExecutions      *metricVec
+	Ingresses           *metricVec
+	Rules               *metricVec
+	Conflicts           *metricVec
+	Cycles              *metricVec
+	LastSuccessfulCycle *metricVec
+	LastCycleChanged    *metricVec
+}
+
+// NewMetrics creates the ingressify metrics
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		RenderDuration: newHistogramVec("ingressify_render_duration_seconds",
+			"Time spent scraping k8s and rendering the templates.", DURATIONBUCKETS),
+		RenderFailures: newMetricVec("counter", "ingressify_render_failures_total",
+			"Number of cycles whose scraping or rendering failed."),
+		HookDuration: newHistogramVec("ingressify_hook_duration_seconds",
+			"Time spent executing hooks.", DURATIONBUCKETS, "hook"),
+		HookExecutions: newMetricVec("counter", "ingressify_hook_executions_total",
+			"Number of hook executions by exit code, -1 when the hook could not be started.", "hook", "exit_code"),
+		Ingresses: newMetricVec("gauge", "ingressify_ingresses",
+			"Number of ingresses scraped in the last cycle.", "namespace"),
+		Rules: newMetricVec("gauge", "ingressify_rules",
+			"Number of rules scraped in the last cycle.", "namespace"),
+		Conflicts: newMetricVec("gauge", "ingressify_conflicting_rules",
+			"Number of rules dropped in the last cycle because another ingress claims their host and path.", "namespace"),
+		Cycles: newMetricVec("counter", "ingressify_cycles_total",
+			"Number of cycles by result: changed, unchanged or failed.", "result"),
+		LastSuccessfulCycle: newMetricVec("gauge", "ingressify_last_successful_cycle_timestamp_seconds",
+			"Unix time of the last successful cycle."),
+		LastCycleChanged: newMetricVec("gauge", "ingressify_last_cycle_changed",
+			"1 when the last successful cycle changed the outputs, 0 otherwise."),
+	}
+	m.RenderFailures.Add(0)
+	return m
+}
+
+// Expose writes all the metrics in the Prometheus text format
+func (m *Metrics) Expose(w io.Writer) {
+	m.Conflicts.writeTo(w)
+	m.Cycles.writeTo(w)
+	m.HookDuration.writeTo(w)
+	m.HookExecutions.writeTo(w)
+	m.Ingresses.writeTo(w)
+	m.LastCycleChanged.writeTo(w)
+	m.LastSuccessfulCycle.writeTo(w)
+	m.RenderDuration.writeTo(w)
+	m.RenderFailures.writeTo(w)
+	m.Rules.writeTo(w)
+}
+
+// ServeHTTP exposes the metrics
+func (m *Metrics) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Expose(writer)
+}
+
+// ObserveHook records the duration and exit code of a hook execution
+func (m *Metrics) ObserveHook(hook string, start time.Time, err error) {
+	m.HookDuration.Observe(time.Since(start).Seconds(), hook)
+	m.HookExecutions.Add(1, hook, strconv.Itoa(ExitCode(err)))
+}
+
+// ObserveScrape records the number of ingresses and rules per namespace
+func (m *Metrics) ObserveScrape(ingresses map[string]int, rules []IngressifyRule) {
+	m.Ingresses.Reset()
+	for ns, count := range ingresses {
+		m.Ingresses.Set(float64(count), ns)
+	}
+	m.Rules.Reset()
+	for _, rule := range rules {
+		m.Rules.Add(1, rule.Namespace)
+	}
+}
+
+// ObserveConflicts records the number of dropped rules per namespace
+func (m *Metrics) ObserveConflicts(conflicts []Conflict) {
+	m.Conflicts.Reset()
+	for _, conflict := range conflicts {
+		m.Conflicts.Add(1, conflict.Loser.Namespace)
+	}
+}
+
+// ObserveCycle records the outcome of a cycle
+func (m *Metrics) ObserveCycle(status *OpsStatus) {
+	switch {
+	case !status.isSuccess:
+		m.Cycles.Add(1, "failed")
+	case status.unchanged:
+		m.Cycles.Add(1, "unchanged")
+		m.LastCycleChanged.Set(0)
+		m.LastSuccessfulCycle.Set(float64(status.timestamp.Unix()))
+	default:
+		m.Cycles.Add(1, "changed")
+		m.LastCycleChanged.Set(1)
+		m.LastSuccessfulCycle.Set(float64(status.timestamp.Unix()))
+	}
+}
+
+var metrics = NewMetrics()
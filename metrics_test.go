@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricVecExposition(t *testing.T) {
+	m := newMetricVec("counter", "test_total", "A test counter.", "hook", "exit_code")
+	m.Add(1, "post_render", "0")
+	m.Add(2, "post_render", "0")
+	m.Add(1, "pre_render", "1")
+	var buf bytes.Buffer
+	m.writeTo(&buf)
+	expected := `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{hook="post_render",exit_code="0"} 3
+test_total{hook="pre_render",exit_code="1"} 1
+`
+	if buf.String() != expected {
+		t.Errorf("Wrong exposition, got:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestHistogramVecExposition(t *testing.T) {
+	h := newHistogramVec("test_seconds", "A test histogram.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+	var buf bytes.Buffer
+	h.writeTo(&buf)
+	expected := `# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5.55
+test_seconds_count 3
+`
+	if buf.String() != expected {
+		t.Errorf("Wrong exposition, got:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	if escaped := escapeLabelValue("a\"b\\c\nd"); escaped != `a\"b\\c\nd` {
+		t.Errorf("Wrong escaping, got: %s", escaped)
+	}
+}
+
+func TestObserveCycle(t *testing.T) {
+	m := NewMetrics()
+	now := time.Now()
+	m.ObserveCycle(&OpsStatus{isSuccess: true, timestamp: now})
+	if m.LastCycleChanged.Get() != 1 || m.LastSuccessfulCycle.Get() != float64(now.Unix()) {
+		t.Errorf("Changed cycle not recorded")
+	}
+	m.ObserveCycle(&OpsStatus{isSuccess: true, unchanged: true, timestamp: now})
+	if m.LastCycleChanged.Get() != 0 || m.Cycles.Get("unchanged") != 1 {
+		t.Errorf("Unchanged cycle not recorded")
+	}
+	m.ObserveCycle(&OpsStatus{isSuccess: false, timestamp: now.Add(time.Minute), error: errors.New("failed")})
+	if m.Cycles.Get("failed") != 1 || m.LastSuccessfulCycle.Get() != float64(now.Unix()) {
+		t.Errorf("Failed cycle should not update the last successful cycle")
+	}
+}
+
+func TestObserveScrapeDropsStaleNamespaces(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveScrape(map[string]int{"ns1": 1, "ns2": 2}, []IngressifyRule{{Namespace: "ns1"}, {Namespace: "ns1"}})
+	m.ObserveScrape(map[string]int{"ns2": 2}, []IngressifyRule{{Namespace: "ns2"}})
+	if m.Ingresses.Get("ns1") != 0 || m.Ingresses.Get("ns2") != 2 || m.Rules.Get("ns1") != 0 || m.Rules.Get("ns2") != 1 {
+		t.Errorf("Wrong scrape metrics, got ingresses: %v, rules: %v", m.Ingresses.values, m.Rules.values)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := NewMetrics()
+	r, _ := http.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, r)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "ingressify_render_failures_total 0\n") {
+		t.Errorf("Wrong metrics response, got: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMetricsParseAsPrometheusText(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveCycle(&OpsStatus{isSuccess: true, timestamp: time.Now()})
+	m.ObserveScrape(map[string]int{"ns1": 1}, []IngressifyRule{{Namespace: "ns1"}})
+	m.ObserveConflicts([]Conflict{{Loser: IngressifyRule{Namespace: "ns2"}}})
+	m.ObserveHook("post_render", time.Now(), nil)
+	m.RenderDuration.Observe(0.2)
+	m.Rules.Set(1, "quoted \"ns\"\\\n")
+	r, _ := http.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, r)
+	families, err := parseExposition(w.Body.String())
+	if err != nil {
+		t.Fatalf("Metrics are not valid Prometheus text, got: %s", err)
+	}
+	if len(families) != 10 {
+		t.Errorf("Wrong number of metric families, got: %d, expected: %d", len(families), 10)
+	}
+	var buckets int
+	var count float64
+	for _, sample := range families["ingressify_render_duration_seconds"].samples {
+		switch sample.name {
+		case "ingressify_render_duration_seconds_bucket":
+			buckets++
+		case "ingressify_render_duration_seconds_count":
+			count = sample.value
+		}
+	}
+	if count != 1 || buckets != len(DURATIONBUCKETS)+1 {
+		t.Errorf("Wrong render duration histogram, got: %d buckets and a count of %g", buckets, count)
+	}
+	var found bool
+	for _, sample := range families["ingressify_rules"].samples {
+		found = found || sample.labels["namespace"] == "quoted \"ns\"\\\n"
+	}
+	if !found {
+		t.Errorf("Escaped label value not parsed back, got: %+v", families["ingressify_rules"].samples)
+	}
+}
+
+type expositionSample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+type expositionFamily struct {
+	kind    string
+	samples []expositionSample
+}
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// parseExposition parses the Prometheus text format strictly enough to catch what a scraper would reject: every
+// family has a HELP and a TYPE before its samples, sample names belong to their family and label values are escaped
+func parseExposition(text string) (map[string]*expositionFamily, error) {
+	families := make(map[string]*expositionFamily)
+	var current string
+	for i, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		fail := func(msg string) (map[string]*expositionFamily, error) {
+			return nil, fmt.Errorf("line %d %q: %s", i+1, line, msg)
+		}
+		if strings.HasPrefix(line, "# HELP ") {
+			fields := strings.SplitN(line[len("# HELP "):], " ", 2)
+			if !metricNameRegexp.MatchString(fields[0]) || families[fields[0]] != nil {
+				return fail("invalid or duplicate family")
+			}
+			current = fields[0]
+			families[current] = &expositionFamily{}
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line[len("# TYPE "):])
+			if len(fields) != 2 || fields[0] != current || families[current].kind != "" {
+				return fail("TYPE must follow the HELP of its family")
+			}
+			switch fields[1] {
+			case "counter", "gauge", "histogram":
+				families[current].kind = fields[1]
+			default:
+				return fail("unknown type")
+			}
+			continue
+		}
+		if current == "" || families[current].kind == "" {
+			return fail("sample before the HELP and TYPE of its family")
+		}
+		sample, err := parseSample(line)
+		if err != nil {
+			return fail(err.Error())
+		}
+		suffix := strings.TrimPrefix(sample.name, current)
+		if !strings.HasPrefix(sample.name, current) || suffix != "" &&
+			(families[current].kind != "histogram" || suffix != "_bucket" && suffix != "_sum" && suffix != "_count") {
+			return fail("sample out of its family")
+		}
+		families[current].samples = append(families[current].samples, sample)
+	}
+	return families, nil
+}
+
+// parseSample parses `name{label="value",...} value`
+func parseSample(line string) (expositionSample, error) {
+	sample := expositionSample{labels: make(map[string]string)}
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		return sample, errors.New("no value")
+	}
+	sample.name, line = line[:end], line[end:]
+	if !metricNameRegexp.MatchString(sample.name) {
+		return sample, errors.New("invalid metric name")
+	}
+	if strings.HasPrefix(line, "{") {
+		line = line[1:]
+		for !strings.HasPrefix(line, "}") {
+			eq := strings.Index(line, "=\"")
+			if eq < 1 {
+				return sample, errors.New("invalid label")
+			}
+			name := line[:eq]
+			var value bytes.Buffer
+			j := eq + 2
+			for ; j < len(line) && line[j] != '"'; j++ {
+				if line[j] != '\\' {
+					value.WriteByte(line[j])
+					continue
+				}
+				if j++; j == len(line) {
+					return sample, errors.New("unterminated escape")
+				}
+				switch line[j] {
+				case '\\', '"':
+					value.WriteByte(line[j])
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					return sample, errors.New("invalid escape in label value")
+				}
+			}
+			if j == len(line) {
+				return sample, errors.New("unterminated label value")
+			}
+			sample.labels[name] = value.String()
+			line = strings.TrimPrefix(line[j+1:], ",")
+		}
+		line = line[1:]
+	}
+	if !strings.HasPrefix(line, " ") {
+		return sample, errors.New("no value")
+	}
+	value, err := strconv.ParseFloat(line[1:], 64)
+	sample.value = value
+	return sample, err
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
+	apierrors "k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/unversioned"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/pkg/runtime"
+	"k8s.io/client-go/pkg/util/intstr"
+	"k8s.io/client-go/pkg/watch"
+)
+
+const (
+	// EXTENSIONSV1BETA1 is the legacy ingress API version
+	EXTENSIONSV1BETA1 = "extensions/v1beta1"
+	// NETWORKINGV1 is the ingress API version served by current clusters
+	NETWORKINGV1 = "networking.k8s.io/v1"
+	// INGRESSCLASSANNOTATION is the annotation holding the ingress class
+	INGRESSCLASSANNOTATION = "kubernetes.io/ingress.class"
+	// PATHTYPEIMPLEMENTATIONSPECIFIC is the pathType of paths that don't set one
+	PATHTYPEIMPLEMENTATIONSPECIFIC = "ImplementationSpecific"
+	// PATHTYPEEXACT matches the path exactly
+	PATHTYPEEXACT = "Exact"
+	// PATHTYPEPREFIX matches the path element-wise, `/foo` matches `/foo` and `/foo/bar` but not `/foobar`
+	PATHTYPEPREFIX = "Prefix"
+)
+
+/*
+	The vendored client only knows about extensions/v1beta1, the types below mirror the parts
+	of networking.k8s.io/v1 we need. They are converted to v1beta1.Ingress right after being
+	scraped so the rest of ingressify deals with a single representation, the class and the path
+	types that v1beta1 can't hold are kept aside in Converted.
+*/
+
+// Converted holds what v1beta1 can't hold of converted ingresses, keyed by namespace/name
+type Converted map[string]ConvertedIngress
+
+// ConvertedIngress is the spec.ingressClassName of an ingress and the path types of its paths, per rule and path
+type ConvertedIngress struct {
+	ClassName string
+	PathTypes [][]string
+}
+
+// PathType returns the path type of the path `j` of the rule `i` of `ing`, defaulting to ImplementationSpecific
+func (c Converted) PathType(ing v1beta1.Ingress, i int, j int) string {
+	types := c[ServiceKey(ing.Namespace, ing.Name)].PathTypes
+	if i < len(types) && j < len(types[i]) {
+		return types[i][j]
+	}
+	return PATHTYPEIMPLEMENTATIONSPECIFIC
+}
+
+// Class returns the class of `ing`, its kubernetes.io/ingress.class annotation or else its spec.ingressClassName
+func (c Converted) Class(ing v1beta1.Ingress) string {
+	if class := ing.Annotations[INGRESSCLASSANNOTATION]; class != "" {
+		return class
+	}
+	return c[ServiceKey(ing.Namespace, ing.Name)].ClassName
+}
+
+// NetworkingIngressList is a networking.k8s.io/v1 IngressList
+type NetworkingIngressList struct {
+	unversioned.TypeMeta `json:",inline"`
+	unversioned.ListMeta `json:"metadata,omitempty"`
+	Items                []NetworkingIngress `json:"items"`
+}
+
+// NetworkingIngress is a networking.k8s.io/v1 Ingress
+type NetworkingIngress struct {
+	unversioned.TypeMeta `json:",inline"`
+	v1.ObjectMeta        `json:"metadata,omitempty"`
+	Spec                 NetworkingIngressSpec `json:"spec,omitempty"`
+	Status               v1beta1.IngressStatus `json:"status,omitempty"`
+}
+
+// NetworkingIngressSpec is a networking.k8s.io/v1 IngressSpec
+type NetworkingIngressSpec struct {
+	IngressClassName *string                   `json:"ingressClassName,omitempty"`
+	DefaultBackend   *NetworkingIngressBackend `json:"defaultBackend,omitempty"`
+	TLS              []v1beta1.IngressTLS      `json:"tls,omitempty"`
+	Rules            []NetworkingIngressRule   `json:"rules,omitempty"`
+}
+
+// NetworkingIngressRule is a networking.k8s.io/v1 IngressRule
+type NetworkingIngressRule struct {
+	Host string                          `json:"host,omitempty"`
+	HTTP *NetworkingHTTPIngressRuleValue `json:"http,omitempty"`
+}
+
+// NetworkingHTTPIngressRuleValue is a networking.k8s.io/v1 HTTPIngressRuleValue
+type NetworkingHTTPIngressRuleValue struct {
+	Paths []NetworkingHTTPIngressPath `json:"paths"`
+}
+
+// NetworkingHTTPIngressPath is a networking.k8s.io/v1 HTTPIngressPath
+type NetworkingHTTPIngressPath struct {
+	Path     string                   `json:"path,omitempty"`
+	PathType *string                  `json:"pathType,omitempty"`
+	Backend  NetworkingIngressBackend `json:"backend"`
+}
+
+// NetworkingIngressBackend is a networking.k8s.io/v1 IngressBackend, resource backends are not supported
+type NetworkingIngressBackend struct {
+	Service *NetworkingServiceBackend `json:"service,omitempty"`
+}
+
+// NetworkingServiceBackend is a networking.k8s.io/v1 IngressServiceBackend
+type NetworkingServiceBackend struct {
+	Name string                       `json:"name"`
+	Port NetworkingServiceBackendPort `json:"port,omitempty"`
+}
+
+// NetworkingServiceBackendPort is a networking.k8s.io/v1 ServiceBackendPort
+type NetworkingServiceBackendPort struct {
+	Name   string `json:"name,omitempty"`
+	Number int32  `json:"number,omitempty"`
+}
+
+// ResolveIngressAPIVersion validates the configured ingress API version,
+// an empty or "auto" version is detected through discovery.
+func ResolveIngressAPIVersion(client kubernetes.Interface, configured string) (string, error) {
+	switch configured {
+	case EXTENSIONSV1BETA1, NETWORKINGV1:
+		return configured, nil
+	case "", "auto":
+		return detectIngressAPIVersion(client.Discovery())
+	default:
+		return "", fmt.Errorf("unsupported ingress API version %q", configured)
+	}
+}
+
+// groupVersionDiscoverer is the part of the discovery client detecting the ingress API version
+type groupVersionDiscoverer interface {
+	ServerResourcesForGroupVersion(groupVersion string) (*unversioned.APIResourceList, error)
+}
+
+// detectIngressAPIVersion picks networking.k8s.io/v1 when the cluster serves its ingresses. Only a group version
+// that is not found falls back to extensions/v1beta1, other discovery errors are returned.
+func detectIngressAPIVersion(discovery groupVersionDiscoverer) (string, error) {
+	resources, err := discovery.ServerResourcesForGroupVersion(NETWORKINGV1)
+	if apierrors.IsNotFound(err) {
+		log.Infof("%s not available, falling back to %s", NETWORKINGV1, EXTENSIONSV1BETA1)
+		return EXTENSIONSV1BETA1, nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to discover %s", NETWORKINGV1)
+	}
+	if resources != nil {
+		for _, resource := range resources.APIResources {
+			if resource.Name == "ingresses" {
+				return NETWORKINGV1, nil
+			}
+		}
+	}
+	return EXTENSIONSV1BETA1, nil
+}
+
+func networkingIngressesPath(namespace string) []string {
+	if namespace == "" {
+		return []string{"/apis", NETWORKINGV1, "ingresses"}
+	}
+	return []string{"/apis", NETWORKINGV1, "namespaces", namespace, "ingresses"}
+}
+
+// ScrapeNetworkingIngresses retrieves networking.k8s.io/v1 ingresses on `namespace` matching the label `selector`
+// and converts them to extensions/v1beta1, returning their path types aside
+func ScrapeNetworkingIngresses(client kubernetes.Interface, namespace string, selector string) (*v1beta1.IngressList, Converted, error) {
+	log.Infof("Fetching %s Ingress rules on namespace = %q matching %q", NETWORKINGV1, namespace, selector)
+	req := client.CoreV1().RESTClient().Get().AbsPath(networkingIngressesPath(namespace)...)
+	if selector != "" {
+		req = req.Param("labelSelector", selector)
+	}
+	raw, err := req.Do().Raw()
+	if err != nil {
+		log.WithError(err).Error("Failed to get list of ingresses rules")
+		return nil, nil, err
+	}
+	var list NetworkingIngressList
+	if err = json.Unmarshal(raw, &list); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decode ingresses")
+	}
+	converted, aside := ToV1beta1IngressList(&list)
+	return converted, aside, nil
+}
+
+// WatchNetworkingIngresses watches networking.k8s.io/v1 ingresses, it behaves like WatchIngresses
+func WatchNetworkingIngresses(client kubernetes.Interface, namespace string, selector string, events chan<- struct{}, stop <-chan struct{}) {
+	watchResource("ingresses", func(opts v1.ListOptions) (watch.Interface, error) {
+		req := client.CoreV1().RESTClient().Get().AbsPath(networkingIngressesPath(namespace)...).
+			Param("watch", "true").Param("resourceVersion", opts.ResourceVersion)
+		if selector != "" {
+			req = req.Param("labelSelector", selector)
+		}
+		stream, err := req.Stream()
+		if err != nil {
+			return nil, err
+		}
+		return watch.NewStreamWatcher(&networkingWatchDecoder{stream: stream, decoder: json.NewDecoder(stream),
+			object: func() runtime.Object { return &NetworkingIngress{} }}), nil
+	}, nil, events, stop)
+}
+
+// networkingWatchDecoder decodes the JSON watch events of networking.k8s.io/v1 resources into `object`
+type networkingWatchDecoder struct {
+	stream  io.ReadCloser
+	decoder *json.Decoder
+	object  func() runtime.Object
+}
+
+func (d *networkingWatchDecoder) Decode() (watch.EventType, runtime.Object, error) {
+	var event struct {
+		Type   watch.EventType `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := d.decoder.Decode(&event); err != nil {
+		return "", nil, err
+	}
+	if event.Type == watch.Error {
+		var status unversioned.Status
+		if err := json.Unmarshal(event.Object, &status); err != nil {
+			return "", nil, err
+		}
+		return event.Type, &status, nil
+	}
+	obj := d.object()
+	if err := json.Unmarshal(event.Object, obj); err != nil {
+		return "", nil, err
+	}
+	return event.Type, obj, nil
+}
+
+func (d *networkingWatchDecoder) Close() {
+	d.stream.Close()
+}
+
+// ToV1beta1IngressList converts networking.k8s.io/v1 ingresses to extensions/v1beta1, returning their class and
+// path types aside
+func ToV1beta1IngressList(list *NetworkingIngressList) (*v1beta1.IngressList, Converted) {
+	res := &v1beta1.IngressList{ListMeta: list.ListMeta}
+	aside := make(Converted)
+	for _, ing := range list.Items {
+		converted, extra := ToV1beta1Ingress(ing)
+		res.Items = append(res.Items, converted)
+		aside[ServiceKey(ing.Namespace, ing.Name)] = extra
+	}
+	return res, aside
+}
+
+// ToV1beta1Ingress converts a networking.k8s.io/v1 ingress to extensions/v1beta1, its metadata is kept as is.
+// It also returns its spec.ingressClassName and its path types per rule and path.
+func ToV1beta1Ingress(ing NetworkingIngress) (v1beta1.Ingress, ConvertedIngress) {
+	res := v1beta1.Ingress{ObjectMeta: ing.ObjectMeta, Status: ing.Status}
+	var extra ConvertedIngress
+	if ing.Spec.IngressClassName != nil {
+		extra.ClassName = *ing.Spec.IngressClassName
+	}
+	if ing.Spec.DefaultBackend != nil {
+		res.Spec.Backend = toV1beta1Backend(*ing.Spec.DefaultBackend)
+	}
+	res.Spec.TLS = ing.Spec.TLS
+	for _, rule := range ing.Spec.Rules {
+		r := v1beta1.IngressRule{Host: rule.Host}
+		var types []string
+		if rule.HTTP != nil {
+			r.HTTP = &v1beta1.HTTPIngressRuleValue{}
+			for _, path := range rule.HTTP.Paths {
+				backend := toV1beta1Backend(path.Backend)
+				if backend == nil {
+					log.Warnf("Ingress %s/%s has a path without service backend, skipping it", ing.Namespace, ing.Name)
+					continue
+				}
+				r.HTTP.Paths = append(r.HTTP.Paths, v1beta1.HTTPIngressPath{Path: path.Path, Backend: *backend})
+				pathType := PATHTYPEIMPLEMENTATIONSPECIFIC
+				if path.PathType != nil {
+					pathType = *path.PathType
+				}
+				types = append(types, pathType)
+			}
+		}
+		res.Spec.Rules = append(res.Spec.Rules, r)
+		extra.PathTypes = append(extra.PathTypes, types)
+	}
+	return res, extra
+}
+
+func toV1beta1Backend(backend NetworkingIngressBackend) *v1beta1.IngressBackend {
+	if backend.Service == nil {
+		return nil
+	}
+	res := &v1beta1.IngressBackend{ServiceName: backend.Service.Name}
+	if backend.Service.Port.Name != "" {
+		res.ServicePort = intstr.FromString(backend.Service.Port.Name)
+	} else {
+		res.ServicePort = intstr.FromInt(int(backend.Service.Port.Number))
+	}
+	return res
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	apierrors "k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/unversioned"
+)
+
+const networkingIngressList = `{
+  "apiVersion": "networking.k8s.io/v1",
+  "kind": "IngressList",
+  "items": [
+    {
+      "metadata": {"name": "n1", "namespace": "ns1"},
+      "spec": {
+        "ingressClassName": "ingressify",
+        "defaultBackend": {"service": {"name": "default", "port": {"number": 80}}},
+        "rules": [
+          {
+            "host": "n1.h1",
+            "http": {
+              "paths": [
+                {"path": "/exact", "pathType": "Exact", "backend": {"service": {"name": "svc1", "port": {"number": 8080}}}},
+                {"path": "/named", "pathType": "Prefix", "backend": {"service": {"name": "svc2", "port": {"name": "http"}}}},
+                {"path": "/resource", "pathType": "Prefix", "backend": {"resource": {"kind": "Bucket", "name": "b"}}},
+                {"path": "/untyped", "backend": {"service": {"name": "svc3", "port": {"number": 8081}}}}
+              ]
+            }
+          }
+        ]
+      }
+    }
+  ]
+}`
+
+func TestToV1beta1IngressList(t *testing.T) {
+	var list NetworkingIngressList
+	if err := json.Unmarshal([]byte(networkingIngressList), &list); err != nil {
+		t.Fatalf("Failed to decode test data: %s", err)
+	}
+	converted, aside := ToV1beta1IngressList(&list)
+	if len(converted.Items) != 1 {
+		t.Fatalf("Wrong number of ingresses, got: %d, expected: %d", len(converted.Items), 1)
+	}
+	ing := converted.Items[0]
+	if ing.Spec.Backend == nil || ing.Spec.Backend.ServiceName != "default" || ing.Spec.Backend.ServicePort.IntVal != 80 {
+		t.Errorf("Default backend not converted, got: %v", ing.Spec.Backend)
+	}
+	if len(ing.Annotations) != 0 {
+		t.Errorf("Class and path types should not leak into annotations, got: %v", ing.Annotations)
+	}
+	rules := ToIngressifyRuleConverted(converted, aside)
+	expected := []IngressifyRule{
+		{ServiceName: "svc1", ServicePort: 8080, Path: "/exact", PathType: "Exact"},
+		{ServiceName: "svc2", ServicePortName: "http", Path: "/named", PathType: "Prefix"},
+		{ServiceName: "svc3", ServicePort: 8081, Path: "/untyped", PathType: PATHTYPEIMPLEMENTATIONSPECIFIC},
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("Wrong number of rules, got: %d, expected: %d", len(rules), len(expected))
+	}
+	for i, r := range rules {
+		e := expected[i]
+		if r.ServiceName != e.ServiceName || r.ServicePort != e.ServicePort || r.ServicePortName != e.ServicePortName ||
+			r.Path != e.Path || r.PathType != e.PathType {
+			t.Errorf("Wrong rule, got: %+v, expected: %+v", r, e)
+		}
+		if r.Host != "n1.h1" || r.IngressClass != "ingressify" {
+			t.Errorf("Wrong host or class, got: %s, %s", r.Host, r.IngressClass)
+		}
+	}
+}
+
+func TestResolveIngressAPIVersion(t *testing.T) {
+	for _, version := range []string{EXTENSIONSV1BETA1, NETWORKINGV1} {
+		if resolved, err := ResolveIngressAPIVersion(nil, version); err != nil || resolved != version {
+			t.Errorf("Explicit version should be kept, got: %s (%v), expected: %s", resolved, err, version)
+		}
+	}
+	if _, err := ResolveIngressAPIVersion(nil, "extensions/v1"); err == nil {
+		t.Errorf("Unknown version should be rejected")
+	}
+}
+
+type fakeDiscovery struct {
+	resources *unversioned.APIResourceList
+	err       error
+}
+
+func (d fakeDiscovery) ServerResourcesForGroupVersion(groupVersion string) (*unversioned.APIResourceList, error) {
+	return d.resources, d.err
+}
+
+func TestDetectIngressAPIVersion(t *testing.T) {
+	served := &unversioned.APIResourceList{GroupVersion: NETWORKINGV1, APIResources: []unversioned.APIResource{{Name: "ingresses"}}}
+	notFound := apierrors.NewNotFound(unversioned.GroupResource{Group: "networking.k8s.io"}, "v1")
+	cases := []struct {
+		discovery fakeDiscovery
+		expected  string
+		fails     bool
+	}{
+		{discovery: fakeDiscovery{resources: served}, expected: NETWORKINGV1},
+		{discovery: fakeDiscovery{resources: &unversioned.APIResourceList{GroupVersion: NETWORKINGV1}}, expected: EXTENSIONSV1BETA1},
+		{discovery: fakeDiscovery{err: notFound}, expected: EXTENSIONSV1BETA1},
+		{discovery: fakeDiscovery{err: errors.New("connection refused")}, fails: true},
+	}
+	for _, c := range cases {
+		version, err := detectIngressAPIVersion(c.discovery)
+		if c.fails {
+			if err == nil {
+				t.Errorf("Discovery error should be returned, got: %s", version)
+			}
+			continue
+		}
+		if err != nil || version != c.expected {
+			t.Errorf("Wrong version, got: %s (%v), expected: %s", version, err, c.expected)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+/*
+	Path matching helpers for templates, they honour the path type of the rule and escape the path so special
+	characters can't break or widen the match. ImplementationSpecific paths, and so extensions/v1beta1 ones, are
+	matched as plain string prefixes.
+*/
+
+// rulePath returns the path of the rule, `/` when the rule has none
+func rulePath(rule IngressifyRule) string {
+	if rule.Path == "" {
+		return "/"
+	}
+	return rule.Path
+}
+
+// prefixPath returns the path of a Prefix rule without trailing slash, `/` when it matches every path
+func prefixPath(rule IngressifyRule) string {
+	path := strings.TrimRight(rulePath(rule), "/")
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// PathRegex returns an anchored regular expression, in the syntax shared by RE2 and PCRE, matching the paths of the rule
+func PathRegex(rule IngressifyRule) string {
+	switch rule.PathType {
+	case PATHTYPEEXACT:
+		return "^" + regexp.QuoteMeta(rulePath(rule)) + "$"
+	case PATHTYPEPREFIX:
+		if path := prefixPath(rule); path != "/" {
+			return "^" + regexp.QuoteMeta(path) + "(/|$)"
+		}
+		return "^/"
+	default:
+		return "^" + regexp.QuoteMeta(rulePath(rule))
+	}
+}
+
+// nginxQuote quotes `s` as an nginx string
+func nginxQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// NginxLocation returns the modifier and the quoted argument of an nginx `location` matching the paths of the rule,
+// e.g. `location {{ NginxLocation . }} { ... }`
+func NginxLocation(rule IngressifyRule) string {
+	switch rule.PathType {
+	case PATHTYPEEXACT:
+		return "= " + nginxQuote(rulePath(rule))
+	case PATHTYPEPREFIX:
+		if prefixPath(rule) == "/" {
+			return nginxQuote("/")
+		}
+		return "~ " + nginxQuote(PathRegex(rule))
+	default:
+		return nginxQuote(rulePath(rule))
+	}
+}
+
+// haproxyQuote quotes `s` as an HAProxy argument, no character is special within single quotes but the quote itself
+func haproxyQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// HAProxyPathACL returns the criterion and the quoted pattern of an HAProxy ACL matching the paths of the rule,
+// e.g. `acl path_{{ .Hash }} {{ HAProxyPathACL . }}`
+func HAProxyPathACL(rule IngressifyRule) string {
+	switch rule.PathType {
+	case PATHTYPEEXACT:
+		return "path " + haproxyQuote(rulePath(rule))
+	case PATHTYPEPREFIX:
+		if prefixPath(rule) == "/" {
+			return "path_beg " + haproxyQuote("/")
+		}
+		return "path_reg " + haproxyQuote(PathRegex(rule))
+	default:
+		return "path_beg " + haproxyQuote(rulePath(rule))
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestPathRegex(t *testing.T) {
+	cases := []struct {
+		rule     IngressifyRule
+		expected string
+		matches  []string
+		rejects  []string
+	}{
+		{IngressifyRule{Path: "/foo.json", PathType: PATHTYPEEXACT}, `^/foo\.json$`,
+			[]string{"/foo.json"}, []string{"/fooXjson", "/foo.json/bar"}},
+		{IngressifyRule{Path: "/foo/", PathType: PATHTYPEPREFIX}, `^/foo(/|$)`,
+			[]string{"/foo", "/foo/", "/foo/bar"}, []string{"/foobar"}},
+		{IngressifyRule{Path: "/", PathType: PATHTYPEPREFIX}, `^/`, []string{"/", "/foo"}, nil},
+		{IngressifyRule{Path: "/a+b", PathType: PATHTYPEIMPLEMENTATIONSPECIFIC}, `^/a\+b`,
+			[]string{"/a+b", "/a+bc"}, []string{"/aab"}},
+		{IngressifyRule{}, `^/`, []string{"/"}, nil},
+	}
+	for _, c := range cases {
+		got := PathRegex(c.rule)
+		if got != c.expected {
+			t.Errorf("Wrong regex for %s %s, got: %s, expected: %s", c.rule.PathType, c.rule.Path, got, c.expected)
+			continue
+		}
+		re := regexp.MustCompile(got)
+		for _, path := range c.matches {
+			if !re.MatchString(path) {
+				t.Errorf("%s should match %s", got, path)
+			}
+		}
+		for _, path := range c.rejects {
+			if re.MatchString(path) {
+				t.Errorf("%s should not match %s", got, path)
+			}
+		}
+	}
+}
+
+func TestNginxLocation(t *testing.T) {
+	cases := []struct {
+		rule     IngressifyRule
+		expected string
+	}{
+		{IngressifyRule{Path: `/a"b`, PathType: PATHTYPEEXACT}, `= "/a\"b"`},
+		{IngressifyRule{Path: "/api", PathType: PATHTYPEPREFIX}, `~ "^/api(/|$)"`},
+		{IngressifyRule{Path: "/", PathType: PATHTYPEPREFIX}, `"/"`},
+		{IngressifyRule{Path: "/a b;{", PathType: PATHTYPEIMPLEMENTATIONSPECIFIC}, `"/a b;{"`},
+	}
+	for _, c := range cases {
+		if got := NginxLocation(c.rule); got != c.expected {
+			t.Errorf("Wrong location for %s %s, got: %s, expected: %s", c.rule.PathType, c.rule.Path, got, c.expected)
+		}
+	}
+}
+
+func TestHAProxyPathACL(t *testing.T) {
+	cases := []struct {
+		rule     IngressifyRule
+		expected string
+	}{
+		{IngressifyRule{Path: "/a b", PathType: PATHTYPEEXACT}, `path '/a b'`},
+		{IngressifyRule{Path: "/v1.0", PathType: PATHTYPEPREFIX}, `path_reg '^/v1\.0(/|$)'`},
+		{IngressifyRule{Path: "/", PathType: PATHTYPEPREFIX}, `path_beg '/'`},
+		{IngressifyRule{Path: "/it's", PathType: PATHTYPEIMPLEMENTATIONSPECIFIC}, `path_beg '/it'\''s'`},
+	}
+	for _, c := range cases {
+		if got := HAProxyPathACL(c.rule); got != c.expected {
+			t.Errorf("Wrong ACL for %s %s, got: %s, expected: %s", c.rule.PathType, c.rule.Path, got, c.expected)
+		}
+	}
+}
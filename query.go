@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+/*
+	Generic template functions over rules. Fields are IngressifyRule fields of type string, number or bool,
+	`annotation:<key>` and `label:<key>` stand for an annotation or a label of the ingress. Annotation keys
+	are resolved like the annotation accessors, see Annotations.
+*/
+
+const (
+	// ANNOTATIONFIELD prefixes the pseudo-fields standing for annotations
+	ANNOTATIONFIELD = "annotation:"
+	// LABELFIELD prefixes the pseudo-fields standing for labels
+	LABELFIELD = "label:"
+)
+
+// Query holds the generic template functions, `annotation:` fields are prefixed like by the annotation accessors
+type Query struct {
+	Annotations Annotations
+}
+
+// FuncMap returns the generic template functions
+func (q Query) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"GroupBy": q.GroupBy,
+		"SortBy":  q.SortBy,
+		"Where":   q.Where,
+		"Unique":  q.Unique,
+	}
+}
+
+// fieldValue returns the value of `field` of the rule
+func (q Query) fieldValue(rule IngressifyRule, field string) (interface{}, error) {
+	if strings.HasPrefix(field, ANNOTATIONFIELD) {
+		return rule.Annotations[q.Annotations.key(strings.TrimPrefix(field, ANNOTATIONFIELD))], nil
+	}
+	if strings.HasPrefix(field, LABELFIELD) {
+		return rule.Labels[strings.TrimPrefix(field, LABELFIELD)], nil
+	}
+	f := reflect.ValueOf(rule).FieldByName(field)
+	if !f.IsValid() {
+		return nil, fmt.Errorf("unknown rule field %q", field)
+	}
+	switch f.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return f.Interface(), nil
+	}
+	return nil, fmt.Errorf("rule field %q is a %s, only string, number and bool fields are supported", field, f.Type())
+}
+
+// fieldString returns the value of `field` of the rule formatted as a string
+func (q Query) fieldString(rule IngressifyRule, field string) (string, error) {
+	v, err := q.fieldValue(rule, field)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(v), nil
+}
+
+// checkFields fails on the first field that can't be used
+func (q Query) checkFields(fields ...string) error {
+	for _, field := range fields {
+		if _, err := q.fieldValue(IngressifyRule{}, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rulesArg splits template arguments ending with the rules into the leading strings and the rules
+func rulesArg(fn string, args []interface{}) ([]string, []IngressifyRule, error) {
+	if len(args) < 2 {
+		return nil, nil, fmt.Errorf("%s expects at least a field and the rules", fn)
+	}
+	rules, ok := args[len(args)-1].([]IngressifyRule)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s expects the rules as last argument, got %T", fn, args[len(args)-1])
+	}
+	var fields []string
+	for _, arg := range args[:len(args)-1] {
+		field, ok := arg.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s expects fields as strings, got %T", fn, arg)
+		}
+		fields = append(fields, field)
+	}
+	return fields, rules, nil
+}
+
+// GroupBy groups the rules, given as last argument, by the values of the given fields joined by `-`,
+// e.g. `GroupBy "Host" "ServicePort" .IngRules`
+func (q Query) GroupBy(args ...interface{}) (map[string][]IngressifyRule, error) {
+	fields, rules, err := rulesArg("GroupBy", args)
+	if err != nil {
+		return nil, err
+	}
+	if err = q.checkFields(fields...); err != nil {
+		return nil, err
+	}
+	return q.groupBy(rules, fields...), nil
+}
+
+// SortBy returns a copy of the rules ordered by `field`, `asc` or `desc`. Rules with the same value keep their order.
+func (q Query) SortBy(field string, order string, rules []IngressifyRule) ([]IngressifyRule, error) {
+	if order != "asc" && order != "desc" {
+		return nil, fmt.Errorf("SortBy expects asc or desc, got %q", order)
+	}
+	if err := q.checkFields(field); err != nil {
+		return nil, err
+	}
+	sorted := append([]IngressifyRule{}, rules...)
+	var err error
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, _ := q.fieldValue(sorted[i], field)
+		b, _ := q.fieldValue(sorted[j], field)
+		c, cerr := compareValues(a, b)
+		if cerr != nil {
+			err = cerr
+		}
+		if order == "desc" {
+			return c > 0
+		}
+		return c < 0
+	})
+	return sorted, err
+}
+
+// whereOps are the operators supported by Where, along with their symbolic aliases
+var whereOps = map[string]string{
+	"eq": "eq", "==": "eq", "ne": "ne", "!=": "ne",
+	"lt": "lt", "<": "lt", "le": "le", "<=": "le", "gt": "gt", ">": "gt", "ge": "ge", ">=": "ge",
+	"contains": "contains", "hasPrefix": "hasPrefix", "hasSuffix": "hasSuffix", "matches": "matches",
+}
+
+// Where returns the rules whose `field` compares to `value` with `op`: eq, ne, lt, le, gt, ge (or ==, !=, <, <=, >,
+// >=), contains, hasPrefix, hasSuffix or matches, a regular expression, e.g. `Where "ServicePort" ">=" 8000 .IngRules`
+func (q Query) Where(field string, op string, value interface{}, rules []IngressifyRule) ([]IngressifyRule, error) {
+	canonical, ok := whereOps[op]
+	if !ok {
+		return nil, fmt.Errorf("Where doesn't support operator %q", op)
+	}
+	op = canonical
+	if err := q.checkFields(field); err != nil {
+		return nil, err
+	}
+	var re *regexp.Regexp
+	if op == "matches" {
+		var err error
+		if re, err = regexp.Compile(fmt.Sprint(value)); err != nil {
+			return nil, fmt.Errorf("Where got an invalid regular expression: %s", err)
+		}
+	}
+	var res []IngressifyRule
+	for _, rule := range rules {
+		v, _ := q.fieldValue(rule, field)
+		match, err := matchValue(v, op, value, re)
+		if err != nil {
+			return nil, fmt.Errorf("Where can't compare %s with %v: %s", field, value, err)
+		}
+		if match {
+			res = append(res, rule)
+		}
+	}
+	return res, nil
+}
+
+func matchValue(v interface{}, op string, value interface{}, re *regexp.Regexp) (bool, error) {
+	s := fmt.Sprint(v)
+	switch op {
+	case "contains":
+		return strings.Contains(s, fmt.Sprint(value)), nil
+	case "hasPrefix":
+		return strings.HasPrefix(s, fmt.Sprint(value)), nil
+	case "hasSuffix":
+		return strings.HasSuffix(s, fmt.Sprint(value)), nil
+	case "matches":
+		return re.MatchString(s), nil
+	}
+	c, err := compareValues(v, value)
+	if err != nil {
+		return false, err
+	}
+	switch op {
+	case "eq":
+		return c == 0, nil
+	case "ne":
+		return c != 0, nil
+	case "lt":
+		return c < 0, nil
+	case "le":
+		return c <= 0, nil
+	case "gt":
+		return c > 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+// Unique returns the first rule for every distinct value of `field`, keeping their order
+func (q Query) Unique(field string, rules []IngressifyRule) ([]IngressifyRule, error) {
+	if err := q.checkFields(field); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var res []IngressifyRule
+	for _, rule := range rules {
+		key, _ := q.fieldString(rule, field)
+		if !seen[key] {
+			seen[key] = true
+			res = append(res, rule)
+		}
+	}
+	return res, nil
+}
+
+// compareValues compares a field value with `b` converted to the type of the field, returning -1, 0 or 1
+func compareValues(a interface{}, b interface{}) (int, error) {
+	switch av := a.(type) {
+	case string:
+		return strings.Compare(av, fmt.Sprint(b)), nil
+	case bool:
+		bv, err := strconv.ParseBool(fmt.Sprint(b))
+		if err != nil {
+			return 0, err
+		}
+		if av == bv {
+			return 0, nil
+		}
+		if bv {
+			return -1, nil
+		}
+		return 1, nil
+	}
+	an, ok := toNumber(a)
+	if !ok {
+		return 0, fmt.Errorf("%v is not comparable", a)
+	}
+	bn, ok := toNumber(b)
+	if !ok {
+		return 0, fmt.Errorf("%v is not a number", b)
+	}
+	switch {
+	case an < bn:
+		return -1, nil
+	case an > bn:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	r := reflect.ValueOf(v)
+	switch r.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(r.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(r.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return r.Float(), true
+	case reflect.String:
+		f, err := strconv.ParseFloat(strings.TrimSpace(r.String()), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+var queriedRules = []IngressifyRule{
+	{Name: "a", Host: "foo.com", Path: "/api", ServicePort: 8080, TLS: true, Labels: map[string]string{"team": "edge"}},
+	{Name: "b", Host: "bar.com", Path: "/", ServicePort: 80},
+	{Name: "c", Host: "foo.com", Path: "/", ServicePort: 80, Labels: map[string]string{"team": "edge"}},
+}
+
+func names(rules []IngressifyRule) string {
+	var res []string
+	for _, rule := range rules {
+		res = append(res, rule.Name)
+	}
+	return strings.Join(res, ",")
+}
+
+func TestGroupBy(t *testing.T) {
+	groups, err := (Query{}).GroupBy("Host", "ServicePort", queriedRules)
+	if err != nil {
+		t.Fatalf("Failed to group rules: %s", err)
+	}
+	if len(groups) != 3 || names(groups["foo.com-80"]) != "c" || names(groups["foo.com-8080"]) != "a" {
+		t.Errorf("Wrong groups, got: %v", groups)
+	}
+	if groups, err = (Query{}).GroupBy("label:team", queriedRules); err != nil || names(groups["edge"]) != "a,c" {
+		t.Errorf("Wrong groups by label, got: %v (%v)", groups, err)
+	}
+	if _, err = (Query{}).GroupBy("Hots", queriedRules); err == nil || !strings.Contains(err.Error(), "Hots") {
+		t.Errorf("Unknown field should fail, got: %v", err)
+	}
+	if _, err = (Query{}).GroupBy("Endpoints", queriedRules); err == nil {
+		t.Errorf("Non scalar field should fail")
+	}
+	if _, err = (Query{}).GroupBy(queriedRules); err == nil {
+		t.Errorf("GroupBy without fields should fail")
+	}
+}
+
+func TestSortBy(t *testing.T) {
+	sorted, err := (Query{}).SortBy("ServicePort", "desc", queriedRules)
+	if err != nil || names(sorted) != "a,b,c" {
+		t.Errorf("Wrong descending order, got: %s (%v), expected: %s", names(sorted), err, "a,b,c")
+	}
+	if sorted, err = (Query{}).SortBy("Host", "asc", queriedRules); err != nil || names(sorted) != "b,a,c" {
+		t.Errorf("Wrong ascending order, got: %s (%v), expected: %s", names(sorted), err, "b,a,c")
+	}
+	if names(queriedRules) != "a,b,c" {
+		t.Errorf("SortBy should not modify its input, got: %s", names(queriedRules))
+	}
+	if _, err = (Query{}).SortBy("Host", "up", queriedRules); err == nil {
+		t.Errorf("Unknown order should fail")
+	}
+}
+
+func TestWhere(t *testing.T) {
+	cases := []struct {
+		field    string
+		op       string
+		value    interface{}
+		expected string
+	}{
+		{"Host", "eq", "foo.com", "a,c"},
+		{"ServicePort", ">=", 8000, "a"},
+		{"ServicePort", "ne", "80", "a"},
+		{"TLS", "eq", true, "a"},
+		{"Path", "hasPrefix", "/a", "a"},
+		{"Host", "matches", "^ba", "b"},
+		{"annotation:missing", "eq", "", "a,b,c"},
+	}
+	for _, c := range cases {
+		res, err := (Query{}).Where(c.field, c.op, c.value, queriedRules)
+		if err != nil || names(res) != c.expected {
+			t.Errorf("Wrong rules for %s %s %v, got: %s (%v), expected: %s", c.field, c.op, c.value, names(res), err, c.expected)
+		}
+	}
+	if _, err := (Query{}).Where("ServicePort", "gt", "many", queriedRules); err == nil {
+		t.Errorf("Comparing a number with a string should fail")
+	}
+	if _, err := (Query{}).Where("Host", "like", "foo", queriedRules); err == nil {
+		t.Errorf("Unknown operator should fail")
+	}
+}
+
+func TestUnique(t *testing.T) {
+	if res, err := (Query{}).Unique("Host", queriedRules); err != nil || names(res) != "a,b" {
+		t.Errorf("Wrong unique rules, got: %s (%v), expected: %s", names(res), err, "a,b")
+	}
+}
+
+func TestQueryFuncsInTemplate(t *testing.T) {
+	funcs := Query{}.FuncMap()
+	tmpl := template.Must(template.New("test").Funcs(funcs).Parse(
+		`{{ range . | Where "Host" "eq" "foo.com" | SortBy "Path" "asc" }}{{ .Name }}{{ end }}`))
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, queriedRules); err != nil || out.String() != "ca" {
+		t.Errorf("Wrong render, got: %s (%v), expected: %s", out.String(), err, "ca")
+	}
+	tmpl = template.Must(template.New("test").Funcs(funcs).Parse(`{{ range . | Where "Hots" "eq" "foo.com" }}{{ end }}`))
+	if err := tmpl.Execute(&out, queriedRules); err == nil {
+		t.Errorf("Unknown field should fail the render")
+	}
+}
+
+func TestQueryAnnotationPrefix(t *testing.T) {
+	rules := []IngressifyRule{
+		{Name: "a", Annotations: map[string]string{"ingressify.omio.com/timeout": "5s"}},
+		{Name: "b", Annotations: map[string]string{"timeout": "5s"}},
+	}
+	query := Query{Annotations: Annotations{Prefix: "ingressify.omio.com"}}
+	if res, err := query.Where("annotation:timeout", "eq", "5s", rules); err != nil || names(res) != "a" {
+		t.Errorf("Annotation key should be prefixed, got: %s (%v), expected: %s", names(res), err, "a")
+	}
+	if res, err := query.Where("annotation:ingressify.omio.com/timeout", "eq", "5s", rules); err != nil || names(res) != "a" {
+		t.Errorf("Qualified annotation key should be kept, got: %s (%v), expected: %s", names(res), err, "a")
+	}
+	if res, err := (Query{}).Where("annotation:timeout", "eq", "5s", rules); err != nil || names(res) != "b" {
+		t.Errorf("Annotation key should not be prefixed without prefix, got: %s (%v), expected: %s", names(res), err, "b")
+	}
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"fmt"
-	"html/template"
 	"io/ioutil"
 	"testing"
+	"text/template"
 
 	"github.com/Masterminds/sprig"
 	"k8s.io/client-go/kubernetes/fake"
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/apex/log"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+// Scope restricts the ingresses an ingressify instance takes care of, so several instances can share a cluster
+type Scope struct {
+	Namespaces        []string `json:"namespaces"`
+	ExcludeNamespaces []string `json:"exclude_namespaces"`
+	NamespaceSelector string   `json:"namespace_selector"`
+	IngressSelector   string   `json:"ingress_selector"`
+	IngressClass      string   `json:"ingress_class"`
+	IngressController string   `json:"ingress_controller"`
+	ClaimUnclassed    bool     `json:"claim_unclassed"`
+}
+
+// scrapedNamespaces returns the namespaces to scrape and watch, "" standing for all of them.
+// Listing only the allowed namespaces keeps ingressify working with namespaced RBAC.
+func (s Scope) scrapedNamespaces() []string {
+	if len(s.Namespaces) == 0 {
+		return []string{""}
+	}
+	return s.Namespaces
+}
+
+// NamespaceFilter returns a predicate telling whether the ingresses of a namespace are in scope
+func (s Scope) NamespaceFilter(client kubernetes.Interface) (func(string) bool, error) {
+	allowed := toSet(s.Namespaces)
+	excluded := toSet(s.ExcludeNamespaces)
+	var selected map[string]bool
+	if s.NamespaceSelector != "" {
+		var err error
+		selected, err = ScrapeNamespaces(client, s.NamespaceSelector)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return func(namespace string) bool {
+		if len(allowed) > 0 && !allowed[namespace] {
+			return false
+		}
+		if selected != nil && !selected[namespace] {
+			return false
+		}
+		return !excluded[namespace]
+	}, nil
+}
+
+// FilterIngresses drops the ingresses whose namespace is not in scope
+func FilterIngresses(il *v1beta1.IngressList, inScope func(string) bool) *v1beta1.IngressList {
+	res := &v1beta1.IngressList{ListMeta: il.ListMeta}
+	for _, ing := range il.Items {
+		if inScope(ing.Namespace) {
+			res.Items = append(res.Items, ing)
+		} else {
+			log.Debugf("Ingress %s/%s is out of scope, skipping it", ing.Namespace, ing.Name)
+		}
+	}
+	return res
+}
+
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestNamespaceFilter(t *testing.T) {
+	team := v1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "a"}}}
+	client := fake.NewSimpleClientset(&team)
+	cases := []struct {
+		scope    Scope
+		expected map[string]bool
+	}{
+		{Scope{}, map[string]bool{"team-a": true, "team-b": true}},
+		{Scope{Namespaces: []string{"team-a"}}, map[string]bool{"team-a": true, "team-b": false}},
+		{Scope{ExcludeNamespaces: []string{"team-a"}}, map[string]bool{"team-a": false, "team-b": true}},
+		{Scope{Namespaces: []string{"team-a"}, ExcludeNamespaces: []string{"team-a"}}, map[string]bool{"team-a": false}},
+		{Scope{NamespaceSelector: "team=a"}, map[string]bool{"team-a": true, "team-b": false}},
+	}
+	for _, c := range cases {
+		inScope, err := c.scope.NamespaceFilter(client)
+		if err != nil {
+			t.Errorf("Failed to build namespace filter: %s", err)
+			continue
+		}
+		for ns, expected := range c.expected {
+			if inScope(ns) != expected {
+				t.Errorf("Wrong scope for namespace %s with %+v, got: %t, expected: %t", ns, c.scope, inScope(ns), expected)
+			}
+		}
+	}
+}
+
+func TestScrapeIngressesInScope(t *testing.T) {
+	rules := generateRules("./examples/ingressList.json")
+	client := fake.NewSimpleClientset(&rules)
+	cases := []struct {
+		scope    Scope
+		expected int
+	}{
+		{Scope{}, 2},
+		{Scope{Namespaces: []string{"ns2"}}, 1},
+		{Scope{Namespaces: []string{"ns1", "ns2"}}, 2},
+		{Scope{ExcludeNamespaces: []string{"ns1"}}, 1},
+	}
+	for _, c := range cases {
+		irules, _, err := scrapeIngresses(Config{Scope: c.scope}, client)
+		if err != nil {
+			t.Errorf("Something went wrong scraping ingress for rules: %s\n", err)
+			continue
+		}
+		if len(irules.Items) != c.expected {
+			t.Errorf("Wrong number of ingresses for %+v, got: %d, expected: %d", c.scope, len(irules.Items), c.expected)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// procDir is where processes are looked up by name
+var procDir = "/proc"
+
+// signals are the signals a SignalHook can send, by name without the SIG prefix
+var signals = map[string]syscall.Signal{
+	"HUP": syscall.SIGHUP, "INT": syscall.SIGINT, "QUIT": syscall.SIGQUIT, "KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1, "USR2": syscall.SIGUSR2, "TERM": syscall.SIGTERM, "WINCH": syscall.SIGWINCH,
+	"TTIN": syscall.SIGTTIN, "TTOU": syscall.SIGTTOU,
+}
+
+// SignalHook is a hook step sending a signal, HUP by default, to a process, e.g. to reload a router sharing the PID
+// namespace of ingressify. The process is the one whose pid is in `pidfile`, or the ones named `process`. In the
+// latter case only the processes whose parent doesn't have the same name are signaled, i.e. the masters.
+type SignalHook struct {
+	Signal  string `json:"signal"`
+	PIDFile string `json:"pidfile"`
+	Process string `json:"process"`
+}
+
+// signal parses the signal, by name with or without the SIG prefix or by number between 1 and 31
+func (h *SignalHook) signal() (syscall.Signal, error) {
+	if h.Signal == "" {
+		return syscall.SIGHUP, nil
+	}
+	if n, err := strconv.Atoi(h.Signal); err == nil {
+		if n < 1 || n > 31 {
+			return 0, fmt.Errorf("invalid signal %d, must be between 1 and 31", n)
+		}
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := signals[strings.TrimPrefix(strings.ToUpper(h.Signal), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", h.Signal)
+}
+
+// signalName returns the name of the signal as configured, without the SIG prefix
+func (h *SignalHook) signalName() string {
+	if h.Signal == "" {
+		return "HUP"
+	}
+	return strings.TrimPrefix(strings.ToUpper(h.Signal), "SIG")
+}
+
+// target describes the processes the hook signals
+func (h *SignalHook) target() string {
+	if h.PIDFile != "" {
+		return "pidfile " + h.PIDFile
+	}
+	return "process " + h.Process
+}
+
+// check fails when the signal is unknown or the hook doesn't have exactly one of pidfile and process
+func (h *SignalHook) check() error {
+	if (h.PIDFile == "") == (h.Process == "") {
+		return errors.New("signal hook must have either a pidfile or a process")
+	}
+	_, err := h.signal()
+	return err
+}
+
+// pids returns the processes to signal
+func (h *SignalHook) pids() ([]int, error) {
+	if h.PIDFile != "" {
+		data, err := ioutil.ReadFile(h.PIDFile)
+		if err != nil {
+			return nil, err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || pid <= 0 {
+			return nil, fmt.Errorf("invalid pid %q in %s", strings.TrimSpace(string(data)), h.PIDFile)
+		}
+		return []int{pid}, nil
+	}
+	procs, err := processesNamed(h.Process)
+	if err != nil {
+		return nil, err
+	}
+	pids := topmostProcesses(procs)
+	if len(pids) == 0 {
+		return nil, fmt.Errorf("no process named %s", h.Process)
+	}
+	return pids, nil
+}
+
+// Run sends the signal to the processes of the hook, failing when there is none. A failure returns a *HookError.
+func (h *SignalHook) Run(opts HookOptions) (HookResult, error) {
+	res := HookResult{Command: []string{"signal " + h.target()}}
+	start := time.Now()
+	err := h.check()
+	var pids []int
+	if err == nil {
+		pids, err = h.pids()
+	}
+	var sent []string
+	if err == nil {
+		sig, _ := h.signal()
+		res.Command[0] = fmt.Sprintf("signal %s to %s", h.signalName(), h.target())
+		log.Infof("Sending %s to %s", h.signalName(), h.target())
+		for _, pid := range pids {
+			if err = syscall.Kill(pid, sig); err != nil {
+				err = errors.Wrapf(err, "failed to signal process %d", pid)
+				break
+			}
+			sent = append(sent, strconv.Itoa(pid))
+		}
+	}
+	res.Duration = time.Since(start)
+	if len(sent) > 0 {
+		res.Stdout = "signaled " + strings.Join(sent, " ") + "\n"
+	}
+	if err != nil {
+		res.ExitCode = -1
+		herr := &HookError{HookResult: res, Timeout: opts.Timeout, Err: err}
+		log.WithError(herr).Error("Failed to signal process")
+		return res, herr
+	}
+	return res, nil
+}
+
+// processesNamed returns the parent of every running process named `name`, by pid. The name is the one of the
+// executable as in /proc/<pid>/comm, truncated to 15 characters by the kernel, or the base name of its first argument.
+func processesNamed(name string) (map[int]int, error) {
+	dirs, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	procs := make(map[int]int)
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		ppid, state, comm, err := procStat(pid)
+		if err != nil || state == "Z" {
+			continue //gone or zombie
+		}
+		if comm == name || procArg0(pid) == name {
+			procs[pid] = ppid
+		}
+	}
+	return procs, nil
+}
+
+// procStat returns the parent, the state and the name of the process `pid` from /proc/<pid>/stat
+func procStat(pid int) (int, string, string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, "", "", err
+	}
+	stat := string(data)
+	open, end := strings.Index(stat, "("), strings.LastIndex(stat, ")")
+	if open < 0 || end < open {
+		return 0, "", "", fmt.Errorf("invalid stat of process %d", pid)
+	}
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 2 {
+		return 0, "", "", fmt.Errorf("invalid stat of process %d", pid)
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	return ppid, fields[0], stat[open+1 : end], err
+}
+
+// procArg0 returns the base name of the first argument of the process `pid`
+func procArg0(pid int) string {
+	data, err := ioutil.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "cmdline"))
+	if err != nil || len(data) == 0 {
+		return ""
+	}
+	return filepath.Base(strings.SplitN(string(data), "\x00", 2)[0])
+}
+
+// topmostProcesses returns the sorted pids of `procs` whose parent is not in `procs`
+func topmostProcesses(procs map[int]int) []int {
+	var pids []int
+	for pid, ppid := range procs {
+		if _, ok := procs[ppid]; !ok {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startNamed runs the shell `script` with a copy of sleep named `name` in its PATH
+func startNamed(t *testing.T, dir string, name string, script string) *exec.Cmd {
+	bin := filepath.Join(dir, name)
+	if _, err := os.Stat(bin); os.IsNotExist(err) {
+		src, err := os.Open("/bin/sleep")
+		if err != nil {
+			t.Fatalf("Failed to open sleep: %s", err)
+		}
+		defer src.Close()
+		dst, err := os.OpenFile(bin, os.O_CREATE|os.O_WRONLY, 0755)
+		if err != nil {
+			t.Fatalf("Failed to copy sleep: %s", err)
+		}
+		io.Copy(dst, src)
+		dst.Close()
+	}
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.Env = append(os.Environ(), "PATH="+dir+":"+os.Getenv("PATH"))
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start %s: %s", name, err)
+	}
+	return cmd
+}
+
+// waitForProcesses waits until `count` processes are named `name`
+func waitForProcesses(t *testing.T, name string, count int) map[int]int {
+	for i := 0; i < 100; i++ {
+		if procs, err := processesNamed(name); err == nil && len(procs) == count {
+			return procs
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("%d processes named %s never showed up", count, name)
+	return nil
+}
+
+func TestSignalHookByPIDFile(t *testing.T) {
+	cmd := exec.Command("/bin/sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start sleep: %s", err)
+	}
+	defer cmd.Process.Kill()
+	pidFile, err := ioutil.TempFile("", "ingressify-pid")
+	if err != nil {
+		t.Fatalf("Failed to create pidfile: %s", err)
+	}
+	defer os.Remove(pidFile.Name())
+	pidFile.WriteString(strconv.Itoa(cmd.Process.Pid) + "\n")
+	pidFile.Close()
+
+	res, err := (&SignalHook{Signal: "SIGTERM", PIDFile: pidFile.Name()}).Run(HookOptions{})
+	if err != nil {
+		t.Fatalf("Failed to signal process: %s", err)
+	}
+	if expected := "signal TERM to pidfile " + pidFile.Name(); res.Command[0] != expected {
+		t.Errorf("Wrong command, got: %s, expected: %s", res.Command[0], expected)
+	}
+	err = cmd.Wait()
+	if status, ok := err.(*exec.ExitError).Sys().(syscall.WaitStatus); !ok || status.Signal() != syscall.SIGTERM {
+		t.Errorf("Process should have been terminated, got: %v", err)
+	}
+	if _, err = (&SignalHook{PIDFile: pidFile.Name()}).Run(HookOptions{}); err == nil {
+		t.Errorf("Signaling a process that is gone should fail")
+	}
+}
+
+func TestSignalHookByName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingressify")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	// a master running the same binary as its worker
+	master := startNamed(t, dir, "ingr-test-sleep", "ingr-test-sleep 30 & exec ingr-test-sleep 30")
+	procs := waitForProcesses(t, "ingr-test-sleep", 2)
+	for pid := range procs {
+		defer syscall.Kill(pid, syscall.SIGKILL)
+	}
+	if pids := topmostProcesses(procs); !reflect.DeepEqual(pids, []int{master.Process.Pid}) {
+		t.Fatalf("Only the master should be signaled, got: %v, expected: %d", pids, master.Process.Pid)
+	}
+	if _, err = (&SignalHook{Signal: "usr1", Process: "ingr-test-sleep"}).Run(HookOptions{}); err != nil {
+		t.Fatalf("Failed to signal process: %s", err)
+	}
+	err = master.Wait()
+	if status, ok := err.(*exec.ExitError).Sys().(syscall.WaitStatus); !ok || status.Signal() != syscall.SIGUSR1 {
+		t.Errorf("Master should have been signaled, got: %v", err)
+	}
+	waitForProcesses(t, "ingr-test-sleep", 1)
+}
+
+func TestSignalHookFailures(t *testing.T) {
+	_, err := (&SignalHook{Process: "ingressify-no-such-process"}).Run(HookOptions{})
+	if expected := "hook signal process ingressify-no-such-process could not be run: no process named ingressify-no-such-process"; err == nil || err.Error() != expected || ExitCode(err) != -1 {
+		t.Errorf("Wrong error, got: %v, expected: %s", err, expected)
+	}
+	if err = (&SignalHook{Signal: "RELOAD", Process: "nginx"}).check(); err == nil {
+		t.Errorf("Unknown signal should be rejected")
+	}
+	for _, sig := range []string{"0", "-1", "32", "64"} {
+		if err = (&SignalHook{Signal: sig, Process: "nginx"}).check(); err == nil {
+			t.Errorf("Signal %s should be rejected", sig)
+		}
+	}
+	if sig, err := (&SignalHook{Signal: "12", Process: "nginx"}).signal(); err != nil || sig != syscall.SIGUSR2 {
+		t.Errorf("Wrong signal, got: %v (%v), expected: %v", sig, err, syscall.SIGUSR2)
+	}
+	if err = (&SignalHook{Process: "nginx", PIDFile: "/run/nginx.pid"}).check(); err == nil {
+		t.Errorf("Hook with both a process and a pidfile should be rejected")
+	}
+	if err = (Hook{PostRender: HookSteps{{Signal: &SignalHook{}}}}).Prepare(nil); err == nil {
+		t.Errorf("Signal hook without target should be rejected")
+	}
+}
@@ -1,12 +1,30 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"github.com/apex/log"
-	"html/template"
+	htmltemplate "html/template"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"text/template"
 )
 
+const (
+	// TEXTENGINE renders templates with text/template, the default
+	TEXTENGINE = "text"
+	// HTMLENGINE renders templates with html/template, escaping output for HTML
+	HTMLENGINE = "html"
+)
+
+// Renderer is implemented by both text/template and html/template templates
+type Renderer interface {
+	Execute(wr io.Writer, data interface{}) error
+}
+
 func readTemplate(tmplpath string) ([]byte, error) {
 	tmpl, err := ioutil.ReadFile(tmplpath)
 	if err != nil {
@@ -26,7 +44,7 @@ func BuildFuncMap(funcs ...template.FuncMap) template.FuncMap {
 	return resmap
 }
 
-// PrepareTemplate creates a template from `tmplpath` initialized with `withfuncs`
+// PrepareTemplate creates a text template from `tmplpath` initialized with `withfuncs`
 func PrepareTemplate(tmplpath string, withfuncs template.FuncMap) (*template.Template, error) {
 	tmplstr, err := readTemplate(tmplpath)
 	if err != nil {
@@ -36,20 +54,215 @@ func PrepareTemplate(tmplpath string, withfuncs template.FuncMap) (*template.Tem
 	return tmpl, nil
 }
 
+// PrepareHTMLTemplate creates an html template from `tmplpath` initialized with `withfuncs`.
+// Its output is escaped for HTML, which is only useful to render e.g. status pages.
+func PrepareHTMLTemplate(tmplpath string, withfuncs template.FuncMap) (*htmltemplate.Template, error) {
+	tmplstr, err := readTemplate(tmplpath)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := htmltemplate.Must(htmltemplate.New("template").Funcs(htmltemplate.FuncMap(withfuncs)).Parse(string(tmplstr)))
+	return tmpl, nil
+}
+
+// prepareRenderer creates the template of `tc` with the engine it is configured with
+func prepareRenderer(tc TemplateConfig, withfuncs template.FuncMap) (Renderer, error) {
+	switch tc.Engine {
+	case "", TEXTENGINE:
+		return PrepareTemplate(tc.InTemplate, withfuncs)
+	case HTMLENGINE:
+		return PrepareHTMLTemplate(tc.InTemplate, withfuncs)
+	default:
+		return nil, fmt.Errorf("unknown template engine %q for %s", tc.Engine, tc.InTemplate)
+	}
+}
+
+// Output is a prepared template along with where and how to write it
+type Output struct {
+	TemplateConfig
+	Tmpl Renderer
+	Mode os.FileMode
+}
+
+// PrepareOutputs prepares every template of `templates`, and the HTTP hooks of each, initialized with `withfuncs`
+func PrepareOutputs(templates []TemplateConfig, withfuncs template.FuncMap) ([]Output, error) {
+	var outputs []Output
+	for _, tc := range templates {
+		mode, err := tc.getMode()
+		if err != nil {
+			return nil, err
+		}
+		if err = tc.Hooks.Prepare(withfuncs); err != nil {
+			return nil, err
+		}
+		tmpl, err := prepareRenderer(tc, withfuncs)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, Output{TemplateConfig: tc, Tmpl: tmpl, Mode: mode})
+	}
+	return outputs, nil
+}
+
 // RenderTemplate renders the template and writes the output to `outpath`
-func RenderTemplate(tmpl *template.Template, outpath string, cxt ICxt) error {
-	output, err := os.Create(outpath)
-	defer output.Close()
+func RenderTemplate(tmpl Renderer, outpath string, cxt ICxt) error {
+	pending, err := RenderPending(tmpl, outpath, cxt)
 	if err != nil {
-		log.WithError(err).Error("Failed to render template")
 		return err
 	}
+	return pending.Commit()
+}
+
+// PendingOutput is a rendered template waiting to be validated and committed to its output path.
+// Changed is false when the rendered content is identical to the current content of the output path.
+// Mode is applied on Commit, when 0 the mode of the current output file is kept.
+// With Remove there is no rendered file, Commit removes the output file instead.
+type PendingOutput struct {
+	OutPath      string
+	TempPath     string
+	Checksum     string
+	Changed      bool
+	Mode         os.FileMode
+	Remove       bool
+	previous     []byte
+	previousMode os.FileMode
+	existed      bool
+}
+
+// fileChecksum returns the hex encoded sha256 of the file at `path`
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// syncAndClose flushes `file` to disk before closing it, so that renaming it never exposes a partial file
+func syncAndClose(file *os.File) error {
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// RenderPending renders the template into a temporary file next to `outpath`, leaving `outpath` untouched
+func RenderPending(tmpl Renderer, outpath string, cxt ICxt) (*PendingOutput, error) {
+	output, err := ioutil.TempFile(filepath.Dir(outpath), "."+filepath.Base(outpath))
+	if err != nil {
+		log.WithError(err).Error("Failed to render template")
+		return nil, err
+	}
+	pending := &PendingOutput{OutPath: outpath, TempPath: output.Name()}
 	log.Info("Rendering template")
-	err = tmpl.Execute(output, cxt)
+	h := sha256.New()
+	err = tmpl.Execute(io.MultiWriter(output, h), cxt)
 	if err != nil {
 		log.WithError(err).Error("Failed to render template")
+		output.Close()
+		pending.Discard()
+		return nil, err
+	}
+	if err = syncAndClose(output); err != nil {
+		log.WithError(err).Error("Failed to write rendered template")
+		pending.Discard()
+		return nil, err
+	}
+	pending.Checksum = hex.EncodeToString(h.Sum(nil))
+	current, err := fileChecksum(outpath)
+	pending.Changed = err != nil || current != pending.Checksum
+	log.WithField("checksum", pending.Checksum).WithField("changed", pending.Changed).Info("Template successfully rendered")
+	return pending, nil
+}
+
+// SetMode sets the mode applied on Commit, the output is changed when the output file has another mode
+func (po *PendingOutput) SetMode(mode os.FileMode) {
+	po.Mode = mode
+	if info, err := os.Stat(po.OutPath); err == nil && mode != 0 && info.Mode().Perm() != mode.Perm() {
+		log.Infof("Mode of %s changes from %s to %s", po.OutPath, info.Mode().Perm(), mode.Perm())
+		po.Changed = true
+	}
+}
+
+// Discard removes the rendered file without committing it
+func (po *PendingOutput) Discard() {
+	if po.TempPath == "" {
+		return
+	}
+	if err := os.Remove(po.TempPath); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Warnf("Failed to remove %s", po.TempPath)
+	}
+}
+
+// Commit atomically replaces the output file with the rendered one, keeping its previous content for Rollback
+func (po *PendingOutput) Commit() error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(po.OutPath); err == nil {
+		mode = info.Mode()
+		po.previous, err = ioutil.ReadFile(po.OutPath)
+		if err != nil {
+			po.Discard()
+			return err
+		}
+		po.previousMode = mode
+		po.existed = true
+	}
+	if po.Remove {
+		if err := os.Remove(po.OutPath); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).Errorf("Failed to remove %s", po.OutPath)
+			return err
+		}
+		log.Infof("Removed %s", po.OutPath)
+		return nil
+	}
+	if po.Mode != 0 {
+		mode = po.Mode
+	}
+	if err := os.Chmod(po.TempPath, mode); err != nil {
+		po.Discard()
+		return err
+	}
+	if err := os.Rename(po.TempPath, po.OutPath); err != nil {
+		log.WithError(err).Errorf("Failed to replace %s", po.OutPath)
+		po.Discard()
 		return err
 	}
-	log.Info("Template successfully rendered")
+	log.Infof("Rendered template committed to %s", po.OutPath)
 	return nil
 }
+
+// Rollback restores the content the output file had before Commit
+func (po *PendingOutput) Rollback() error {
+	if !po.existed && po.Remove {
+		return nil
+	}
+	if !po.existed {
+		log.Infof("Removing %s, it did not exist before", po.OutPath)
+		return os.Remove(po.OutPath)
+	}
+	log.Infof("Restoring previous content of %s", po.OutPath)
+	restore, err := ioutil.TempFile(filepath.Dir(po.OutPath), "."+filepath.Base(po.OutPath))
+	if err != nil {
+		return err
+	}
+	if _, err = restore.Write(po.previous); err != nil {
+		restore.Close()
+		os.Remove(restore.Name())
+		return err
+	}
+	if err = syncAndClose(restore); err != nil {
+		os.Remove(restore.Name())
+		return err
+	}
+	if err = os.Chmod(restore.Name(), po.previousMode); err != nil {
+		os.Remove(restore.Name())
+		return err
+	}
+	return os.Rename(restore.Name(), po.OutPath)
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
-	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
 	"testing"
+	"text/template"
 )
 
 func TestBuildFuncMap(t *testing.T) {
@@ -53,3 +57,166 @@ func getFunctionName(f interface{}) string {
 func getFunctionPointer(f interface{}) uintptr {
 	return reflect.ValueOf(f).Pointer()
 }
+
+func TestRenderPendingLeavesOutputUntouchedUntilCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingressify")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	outpath := filepath.Join(dir, "out.cfg")
+	if err = ioutil.WriteFile(outpath, []byte("previous"), 0600); err != nil {
+		t.Fatalf("Failed to write output: %s", err)
+	}
+	tmpl := template.Must(template.New("test").Parse("rendered"))
+
+	pending, err := RenderPending(tmpl, outpath, ICxt{})
+	if err != nil {
+		t.Fatalf("Failed to render: %s", err)
+	}
+	if content, _ := ioutil.ReadFile(outpath); string(content) != "previous" {
+		t.Errorf("Output changed before commit, got: %s", content)
+	}
+	if content, _ := ioutil.ReadFile(pending.TempPath); string(content) != "rendered" {
+		t.Errorf("Wrong pending content, got: %s", content)
+	}
+
+	if err = pending.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %s", err)
+	}
+	if content, _ := ioutil.ReadFile(outpath); string(content) != "rendered" {
+		t.Errorf("Output not replaced on commit, got: %s", content)
+	}
+	if info, _ := os.Stat(outpath); info.Mode().Perm() != 0600 {
+		t.Errorf("File mode not preserved, got: %s", info.Mode())
+	}
+
+	if err = pending.Rollback(); err != nil {
+		t.Fatalf("Failed to rollback: %s", err)
+	}
+	if content, _ := ioutil.ReadFile(outpath); string(content) != "previous" {
+		t.Errorf("Output not restored on rollback, got: %s", content)
+	}
+}
+
+func TestDiscardRemovesPendingOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingressify")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	outpath := filepath.Join(dir, "out.cfg")
+	pending, err := RenderPending(template.Must(template.New("test").Parse("rendered")), outpath, ICxt{})
+	if err != nil {
+		t.Fatalf("Failed to render: %s", err)
+	}
+	pending.Discard()
+	if _, err = os.Stat(pending.TempPath); !os.IsNotExist(err) {
+		t.Errorf("Pending output was not removed")
+	}
+	if _, err = os.Stat(outpath); !os.IsNotExist(err) {
+		t.Errorf("Output should not exist")
+	}
+}
+
+func TestRenderPendingDetectsUnchangedOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingressify")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	outpath := filepath.Join(dir, "out.cfg")
+	tmpl := template.Must(template.New("test").Parse("rendered"))
+
+	pending, err := RenderPending(tmpl, outpath, ICxt{})
+	if err != nil {
+		t.Fatalf("Failed to render: %s", err)
+	}
+	if !pending.Changed {
+		t.Errorf("Output should be changed when the output file does not exist")
+	}
+	if err = pending.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %s", err)
+	}
+	checksum := pending.Checksum
+
+	pending, err = RenderPending(tmpl, outpath, ICxt{})
+	if err != nil {
+		t.Fatalf("Failed to render: %s", err)
+	}
+	defer pending.Discard()
+	if pending.Changed {
+		t.Errorf("Output should be unchanged when rendering the same content")
+	}
+	if pending.Checksum != checksum {
+		t.Errorf("Checksum differs for the same content, got: %s, expected: %s", pending.Checksum, checksum)
+	}
+}
+
+func TestSetModeDetectsModeChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingressify")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	outpath := filepath.Join(dir, "out.cfg")
+	if err = ioutil.WriteFile(outpath, []byte("rendered"), 0644); err != nil {
+		t.Fatalf("Failed to write output: %s", err)
+	}
+	tmpl := template.Must(template.New("test").Parse("rendered"))
+
+	pending, err := RenderPending(tmpl, outpath, ICxt{})
+	if err != nil {
+		t.Fatalf("Failed to render: %s", err)
+	}
+	if pending.SetMode(0644); pending.Changed {
+		t.Errorf("Output should be unchanged with the same content and mode")
+	}
+	if pending.SetMode(0600); !pending.Changed {
+		t.Errorf("Output should be changed when only its mode changes")
+	}
+	if err = pending.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %s", err)
+	}
+	info, err := os.Stat(outpath)
+	if err != nil {
+		t.Fatalf("Failed to stat output: %s", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Wrong mode, got: %v, expected: %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+}
+
+func TestPrepareRendererEngines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingressify")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	tmplpath := filepath.Join(dir, "in.tmpl")
+	if err = ioutil.WriteFile(tmplpath, []byte(`{{ "path_reg ^/a&b<c>" }}`), 0644); err != nil {
+		t.Fatalf("Failed to write template: %s", err)
+	}
+	expected := map[string]string{
+		"":         "path_reg ^/a&b<c>",
+		TEXTENGINE: "path_reg ^/a&b<c>",
+		HTMLENGINE: "path_reg ^/a&amp;b&lt;c&gt;",
+	}
+	for engine, output := range expected {
+		renderer, err := prepareRenderer(TemplateConfig{InTemplate: tmplpath, Engine: engine}, template.FuncMap{})
+		if err != nil {
+			t.Errorf("Failed to prepare template for engine %q: %s", engine, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err = renderer.Execute(&buf, nil); err != nil {
+			t.Errorf("Failed to render template for engine %q: %s", engine, err)
+		}
+		if buf.String() != output {
+			t.Errorf("Wrong output for engine %q, got: %s, expected: %s", engine, buf.String(), output)
+		}
+	}
+	if _, err = prepareRenderer(TemplateConfig{InTemplate: tmplpath, Engine: "jinja"}, template.FuncMap{}); err == nil {
+		t.Errorf("Unknown engine should be rejected")
+	}
+}
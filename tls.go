@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+// CERTEXTENSION is the extension of the PEM bundles written to `tls_dir`
+const CERTEXTENSION = ".pem"
+
+// tlsSecret returns the secret of the TLS section of `ing` covering `host`, if any
+func tlsSecret(ing v1beta1.Ingress, host string) (string, bool) {
+	if host == "" {
+		return "", false
+	}
+	for _, tls := range ing.Spec.TLS {
+		for _, tlsHost := range tls.Hosts {
+			if matchesHost(tlsHost, host) {
+				return tls.SecretName, true
+			}
+		}
+	}
+	return "", false
+}
+
+// matchesHost tells whether `host` is covered by `pattern`, a wildcard only covering a single label
+func matchesHost(pattern string, host string) bool {
+	if !strings.HasPrefix(pattern, "*.") {
+		return pattern == host
+	}
+	i := strings.Index(host, ".")
+	return i > 0 && host[i:] == pattern[1:]
+}
+
+// certFileName returns the name of the PEM bundle of `host`, wildcards are written as `_`
+func certFileName(host string) string {
+	return strings.Replace(host, "*", "_", -1) + CERTEXTENSION
+}
+
+// pemBundle concatenates the certificate chain and the private key of a `kubernetes.io/tls` secret
+func pemBundle(secret v1.Secret) ([]byte, bool) {
+	cert, key := secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]
+	if len(cert) == 0 || len(key) == 0 {
+		return nil, false
+	}
+	var bundle bytes.Buffer
+	bundle.Write(cert)
+	if !bytes.HasSuffix(cert, []byte("\n")) {
+		bundle.WriteString("\n")
+	}
+	bundle.Write(key)
+	return bundle.Bytes(), true
+}
+
+// StageCertificates stages one PEM bundle per TLS host of `rules` in `dir`, which is owned by ingressify: the bundles
+// of hosts no TLS rule references anymore are staged for removal, hosts whose secret can't be read keep their current
+// bundle. Only changes are staged, as outputs committed and rolled back along with the rendered templates, nothing is
+// written to `dir` yet. The bundle of a host is the one of the ingress owning it, see tlsOwners. It returns the path
+// of the bundle of every host and the staged changes.
+func StageCertificates(dir string, rules []IngressifyRule, secrets map[string]v1.Secret, namespacePriority []string) (map[string]string, []*PendingOutput, error) {
+	certs := make(map[string]string)
+	var staged []*PendingOutput
+	for _, rule := range tlsOwners(rules, namespacePriority) {
+		key := ServiceKey(rule.Namespace, rule.TLSSecret)
+		path := filepath.Join(dir, certFileName(rule.Host))
+		bundle, ok := pemBundle(secrets[key])
+		if !ok {
+			// e.g. a secret being rotated, the host keeps being served with its current bundle
+			if _, err := os.Stat(path); err == nil {
+				log.Warnf("Secret %s of host %s is missing or has no certificate or key, keeping %s", key, rule.Host, path)
+				certs[rule.Host] = path
+			} else {
+				log.Warnf("Secret %s of host %s is missing or has no certificate or key, skipping it", key, rule.Host)
+			}
+			continue
+		}
+		certs[rule.Host] = path
+		pending, err := stageCertificate(path, bundle)
+		if err != nil {
+			discardAll(staged)
+			return nil, nil, err
+		}
+		if pending != nil {
+			staged = append(staged, pending)
+		}
+	}
+	stale, err := staleCertificates(dir, certs)
+	if err != nil {
+		discardAll(staged)
+		return nil, nil, err
+	}
+	for _, path := range stale {
+		log.Infof("Certificate %s is stale, staging its removal", path)
+		staged = append(staged, &PendingOutput{OutPath: path, Changed: true, Remove: true})
+	}
+	return certs, staged, nil
+}
+
+// tlsOwners returns the rule of the ingress owning the certificate of every TLS host of `rules`, sorted by host.
+// Like for conflicting rules, the owner is the ingress winning according to `namespacePriority` (see precedes),
+// so that an ingress of another namespace can't supply the certificate of a host. Secrets of other ingresses
+// claiming the host are ignored.
+func tlsOwners(rules []IngressifyRule, namespacePriority []string) []IngressifyRule {
+	priority := priorities(namespacePriority)
+	owners := make(map[string]IngressifyRule)
+	for _, rule := range rules {
+		if !rule.TLS || rule.TLSSecret == "" {
+			continue
+		}
+		if owner, ok := owners[rule.Host]; !ok || precedes(rule, owner, priority) {
+			owners[rule.Host] = rule
+		}
+	}
+	ignored := make(map[string]bool)
+	for _, rule := range rules {
+		owner, ok := owners[rule.Host]
+		if !ok || !rule.TLS || rule.TLSSecret == "" || ingressKey(rule) == ingressKey(owner) {
+			continue
+		}
+		key := ServiceKey(rule.Namespace, rule.TLSSecret)
+		if key != ServiceKey(owner.Namespace, owner.TLSSecret) && !ignored[rule.Host+"\xff"+key] {
+			ignored[rule.Host+"\xff"+key] = true
+			log.Warnf("Ingress %s claims host %q with secret %s, ignoring it for the secret %s/%s of ingress %s",
+				ingressKey(rule), rule.Host, key, owner.Namespace, owner.TLSSecret, ingressKey(owner))
+		}
+	}
+	hosts := make([]string, 0, len(owners))
+	for host := range owners {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	sorted := make([]IngressifyRule, len(hosts))
+	for i, host := range hosts {
+		sorted[i] = owners[host]
+	}
+	return sorted
+}
+
+// WithCertificates sets the PEM bundle of every TLS rule whose certificate was written
+func WithCertificates(rules []IngressifyRule, certs map[string]string) []IngressifyRule {
+	for i := range rules {
+		if rules[i].TLS {
+			rules[i].TLSCertFile = certs[rules[i].Host]
+		}
+	}
+	return rules
+}
+
+// stageCertificate writes `content` to a temporary file next to `path`, readable by the owner only, unless it is
+// identical to the current content of `path`
+func stageCertificate(path string, content []byte) (*PendingOutput, error) {
+	if current, err := ioutil.ReadFile(path); err == nil && bytes.Equal(current, content) {
+		return nil, nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create temporary file for %s", path)
+	}
+	pending := &PendingOutput{OutPath: path, TempPath: tmp.Name(), Changed: true, Mode: 0600}
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+	} else {
+		err = syncAndClose(tmp)
+	}
+	if err != nil {
+		pending.Discard()
+		return nil, errors.Wrapf(err, "failed to write certificate %s", path)
+	}
+	log.Infof("Staged certificate %s", path)
+	return pending, nil
+}
+
+// staleCertificates returns the PEM bundles of `dir` not in `certs`
+func staleCertificates(dir string, certs map[string]string) ([]string, error) {
+	current := make(map[string]bool)
+	for _, path := range certs {
+		current[path] = true
+	}
+	bundles, err := filepath.Glob(filepath.Join(dir, "*"+CERTEXTENSION))
+	if err != nil {
+		return nil, err
+	}
+	var stale []string
+	for _, path := range bundles {
+		if !current[path] {
+			stale = append(stale, path)
+		}
+	}
+	return stale, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+func TestMatchesHost(t *testing.T) {
+	cases := []struct {
+		pattern  string
+		host     string
+		expected bool
+	}{
+		{"foo.com", "foo.com", true},
+		{"foo.com", "bar.com", false},
+		{"*.foo.com", "a.foo.com", true},
+		{"*.foo.com", "a.b.foo.com", false},
+		{"*.foo.com", "foo.com", false},
+	}
+	for _, c := range cases {
+		if got := matchesHost(c.pattern, c.host); got != c.expected {
+			t.Errorf("Wrong match of %s against %s, got: %t, expected: %t", c.host, c.pattern, got, c.expected)
+		}
+	}
+}
+
+func TestToIngressifyRuleTLS(t *testing.T) {
+	testRules := generateRules("./examples/ingressList.json")
+	testRules.Items[0].Spec.TLS = []v1beta1.IngressTLS{{Hosts: []string{"n1.h1"}, SecretName: "n1-cert"}}
+	for _, rule := range ToIngressifyRule(&testRules) {
+		expected := rule.Namespace == "ns1" && rule.Host == "n1.h1"
+		if rule.TLS != expected {
+			t.Errorf("Wrong TLS for host %q, got: %t, expected: %t", rule.Host, rule.TLS, expected)
+		}
+		if expected && rule.TLSSecret != "n1-cert" {
+			t.Errorf("Wrong TLS secret, got: %s, expected: %s", rule.TLSSecret, "n1-cert")
+		}
+	}
+}
+
+func TestStageCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingressify")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	stale := filepath.Join(dir, "gone.com.pem")
+	if err = ioutil.WriteFile(stale, []byte("old"), 0600); err != nil {
+		t.Fatalf("Failed to write stale certificate: %s", err)
+	}
+	rules := []IngressifyRule{
+		{Namespace: "ns1", Host: "*.foo.com", TLS: true, TLSSecret: "foo"},
+		{Namespace: "ns1", Host: "bar.com", TLS: true, TLSSecret: "missing"},
+		{Namespace: "ns1", Host: "plain.com"},
+	}
+	secrets := map[string]v1.Secret{"ns1/foo": {Type: v1.SecretTypeTLS,
+		Data: map[string][]byte{v1.TLSCertKey: []byte("CERT"), v1.TLSPrivateKeyKey: []byte("KEY\n")}}}
+
+	certs, staged, err := StageCertificates(dir, rules, secrets, nil)
+	if err != nil {
+		t.Fatalf("Failed to stage certificates: %s", err)
+	}
+	path := filepath.Join(dir, "_.foo.com.pem")
+	if len(certs) != 1 || certs["*.foo.com"] != path || len(staged) != 2 {
+		t.Errorf("Wrong certificates, got: %v with %d changes, expected: %s", certs, len(staged), path)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Staged certificate should not be written before commit")
+	}
+	if _, err = os.Stat(stale); err != nil {
+		t.Errorf("Stale certificate should not be removed before commit")
+	}
+	if err = commitAll(staged); err != nil {
+		t.Fatalf("Failed to commit certificates: %s", err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "CERT\nKEY\n" {
+		t.Errorf("Wrong PEM bundle, got: %q, expected: %q", content, "CERT\nKEY\n")
+	}
+	if _, err = os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Stale certificate should be removed")
+	}
+	if _, restaged, _ := StageCertificates(dir, rules, secrets, nil); len(restaged) != 0 {
+		t.Errorf("Unchanged certificates should not be staged, got: %d changes", len(restaged))
+	}
+	if err = rollbackAll(staged); err != nil {
+		t.Fatalf("Failed to roll back certificates: %s", err)
+	}
+	if content, _ := ioutil.ReadFile(stale); string(content) != "old" {
+		t.Errorf("Stale certificate should be restored, got: %q", content)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("New certificate should be removed on rollback")
+	}
+	if rules = WithCertificates(rules, certs); rules[0].TLSCertFile != path || rules[1].TLSCertFile != "" {
+		t.Errorf("Wrong certificate files, got: %v", rules)
+	}
+}
+
+func TestStageCertificatesKeepsBundleOfUnreadableSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingressify")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bar.com.pem")
+	if err = ioutil.WriteFile(path, []byte("live"), 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %s", err)
+	}
+	rules := []IngressifyRule{{Namespace: "ns1", Host: "bar.com", TLS: true, TLSSecret: "missing"}}
+	certs, staged, err := StageCertificates(dir, rules, map[string]v1.Secret{}, nil)
+	if err != nil {
+		t.Fatalf("Failed to stage certificates: %s", err)
+	}
+	if certs["bar.com"] != path || len(staged) != 0 {
+		t.Errorf("Current certificate should be kept, got: %v with %d changes", certs, len(staged))
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "live" {
+		t.Errorf("Current certificate should not be changed, got: %q", content)
+	}
+}
+
+func TestTLSOwners(t *testing.T) {
+	rules := []IngressifyRule{
+		{Namespace: "team-b", Name: "shop", Host: "shop.com", Path: "/b", TLS: true, TLSSecret: "evil"},
+		{Namespace: "team-a", Name: "shop", Host: "shop.com", Path: "/", TLS: true, TLSSecret: "shop"},
+		{Namespace: "team-b", Name: "blog", Host: "blog.com", TLS: true, TLSSecret: "blog"},
+		{Namespace: "team-b", Name: "plain", Host: "plain.com"},
+	}
+	owners := tlsOwners(rules, []string{"team-a"})
+	if len(owners) != 2 || owners[0].Host != "blog.com" || owners[1].Host != "shop.com" {
+		t.Fatalf("Wrong TLS hosts, got: %v", owners)
+	}
+	if owners[1].Namespace != "team-a" || owners[1].TLSSecret != "shop" {
+		t.Errorf("Host should be owned by the winning namespace, got: %s/%s", owners[1].Namespace, owners[1].TLSSecret)
+	}
+	if owners = tlsOwners(rules, []string{"team-b"}); owners[1].Namespace != "team-b" {
+		t.Errorf("Namespace priority should decide the owner, got: %s", owners[1].Namespace)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// WEBHOOKMAXRESPONSE is the maximum number of bytes of the response of an HTTP hook that are kept
+const WEBHOOKMAXRESPONSE = 64 * 1024
+
+// HTTPHook is a hook step performing an HTTP request, e.g. to reload a router through its admin API.
+// The body is a template rendered from the same context as the outputs, empty before they are rendered. In validate
+// hooks `{{file}}` is replaced by the path of the rendered file in the url and the body.
+// Without `expected_status` any 2xx status is a success, `timeout` defaults to the timeout of the hook.
+type HTTPHook struct {
+	Method         string            `json:"method"`
+	URL            string            `json:"url"`
+	Headers        map[string]string `json:"headers"`
+	Body           string            `json:"body"`
+	ExpectedStatus []int             `json:"expected_status"`
+	Timeout        string            `json:"timeout"`
+	TLS            HTTPTLS           `json:"tls"`
+	body           *template.Template
+}
+
+// HTTPTLS configures the TLS connections of an HTTP hook, files are read on every request so they can be rotated
+type HTTPTLS struct {
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+func (t HTTPTLS) config() (*tls.Config, error) {
+	conf := &tls.Config{ServerName: t.ServerName, InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CAFile != "" {
+		ca, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// method returns the method of the request, POST when there is a body and GET otherwise by default
+func (h *HTTPHook) method() string {
+	if h.Method != "" {
+		return strings.ToUpper(h.Method)
+	}
+	if h.Body != "" {
+		return http.MethodPost
+	}
+	return http.MethodGet
+}
+
+// prepare parses the body template with `funcs` and a `file` function, which returns the path of the rendered file
+// in validate hooks and an empty string otherwise
+func (h *HTTPHook) prepare(funcs template.FuncMap) error {
+	if h.URL == "" {
+		return errors.New("HTTP hook has no url")
+	}
+	body, err := template.New(h.URL).Funcs(funcs).Funcs(fileFunc("")).Parse(h.Body)
+	if err != nil {
+		return errors.Wrapf(err, "invalid body of HTTP hook %s", h.URL)
+	}
+	h.body = body
+	return nil
+}
+
+// withFile returns a copy of the hook with FILEPLACEHOLDER replaced by `file` in its url and the `file` function of
+// its body returning `file`
+func (h *HTTPHook) withFile(file string) *HTTPHook {
+	res := *h
+	res.URL = strings.Replace(h.URL, FILEPLACEHOLDER, file, -1)
+	if h.body == nil {
+		if err := h.prepare(nil); err != nil {
+			return &res // fails again when run
+		}
+	}
+	body, err := h.body.Clone()
+	if err == nil {
+		res.body = body.Funcs(fileFunc(file))
+	}
+	return &res
+}
+
+func fileFunc(file string) template.FuncMap {
+	return template.FuncMap{"file": func() string { return file }}
+}
+
+func (h *HTTPHook) expects(status int) bool {
+	if len(h.ExpectedStatus) == 0 {
+		return status >= 200 && status < 300
+	}
+	for _, expected := range h.ExpectedStatus {
+		if status == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// Run performs the request with the timeout and context of `opts`. The response body is the output of the hook,
+// its error output when the status is not expected. A failed request returns a *HookError.
+func (h *HTTPHook) Run(opts HookOptions) (HookResult, error) {
+	res := HookResult{Command: []string{h.method() + " " + h.URL}}
+	start := time.Now()
+	fail := func(err error) (HookResult, error) {
+		res.Duration = time.Since(start)
+		if res.ExitCode == 0 {
+			res.ExitCode = -1
+		}
+		herr := &HookError{HookResult: res, Timeout: opts.Timeout, Err: err}
+		log.WithError(herr).Error("Failed to call HTTP hook")
+		return res, herr
+	}
+	if h.Timeout != "" {
+		timeout, err := time.ParseDuration(h.Timeout)
+		if err != nil {
+			return fail(errors.Wrapf(err, "invalid timeout %q", h.Timeout))
+		}
+		opts.Timeout = timeout
+	}
+	if h.body == nil {
+		if err := h.prepare(nil); err != nil {
+			return fail(err)
+		}
+	}
+	var body bytes.Buffer
+	if err := h.body.Execute(&body, opts.Context); err != nil {
+		return fail(errors.Wrap(err, "failed to render body"))
+	}
+	log.Infof("Calling HTTP hook %s", h.URL)
+	req, err := http.NewRequest(h.method(), h.URL, &body)
+	if err != nil {
+		return fail(err)
+	}
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-opts.Stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req = req.WithContext(ctx)
+	tlsConfig, err := h.TLS.config()
+	if err != nil {
+		return fail(err)
+	}
+	client := &http.Client{
+		Timeout:   opts.Timeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig, DisableKeepAlives: true},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if terr, ok := err.(interface {
+			Timeout() bool
+		}); ok && terr.Timeout() {
+			res.TimedOut = true
+		}
+		res.Stopped = stopped(opts)
+		return fail(err)
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(resp.Body, WEBHOOKMAXRESPONSE))
+	res.Status = resp.StatusCode
+	if err != nil {
+		return fail(err)
+	}
+	if !h.expects(resp.StatusCode) {
+		res.Stderr = string(out)
+		res.ExitCode = 1
+		return fail(fmt.Errorf("unexpected status %s", resp.Status))
+	}
+	res.Stdout = string(out)
+	res.Duration = time.Since(start)
+	return res, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+func TestHTTPHookRun(t *testing.T) {
+	var method, token, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		method, token, body = r.Method, r.Header.Get("Authorization"), string(data)
+		w.Write([]byte("reloaded"))
+	}))
+	defer server.Close()
+	hook := &HTTPHook{
+		URL:     server.URL + "/load",
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+		Body:    `{"hosts": {{ len .IngRules | printf "%d" }}, "first": "{{ (index .IngRules 0).Host | upper }}"}`,
+	}
+	if err := hook.prepare(template.FuncMap{"upper": strings.ToUpper}); err != nil {
+		t.Fatalf("Failed to prepare hook: %s", err)
+	}
+	res, err := hook.Run(HookOptions{Context: ICxt{IngRules: []IngressifyRule{{Host: "a.example.com"}}}})
+	if err != nil || res.Status != http.StatusOK || res.Stdout != "reloaded" {
+		t.Errorf("Hook should succeed, got: %+v (%v)", res, err)
+	}
+	if method != http.MethodPost || token != "Bearer secret" {
+		t.Errorf("Wrong request, got: %s with %q", method, token)
+	}
+	if expected := `{"hosts": 1, "first": "A.EXAMPLE.COM"}`; body != expected {
+		t.Errorf("Wrong body, got: %s, expected: %s", body, expected)
+	}
+}
+
+func TestHTTPHookUnexpectedStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("config rejected\n"))
+	}))
+	defer server.Close()
+	hook := &HTTPHook{URL: server.URL}
+	res, err := hook.Run(HookOptions{})
+	expected := "hook GET " + server.URL + " returned status 503: config rejected"
+	if err == nil || err.Error() != expected || ExitCode(err) != 1 || res.Stderr != "config rejected\n" {
+		t.Errorf("Wrong failure, got: %v, expected: %s", err, expected)
+	}
+	hook = &HTTPHook{URL: server.URL, ExpectedStatus: []int{http.StatusServiceUnavailable}}
+	if _, err = hook.Run(HookOptions{}); err != nil {
+		t.Errorf("Expected status should succeed, got: %s", err)
+	}
+}
+
+func TestHTTPHookTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer server.Close()
+	hook := &HTTPHook{URL: server.URL, Timeout: "50ms"}
+	res, err := hook.Run(HookOptions{Timeout: time.Minute})
+	if err == nil || !res.TimedOut || !strings.Contains(err.Error(), "timed out after 50ms") {
+		t.Errorf("Hook should time out, got: %v", err)
+	}
+}
+
+func TestHTTPHookTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	if _, err := (&HTTPHook{URL: server.URL}).Run(HookOptions{}); err == nil {
+		t.Errorf("Unknown certificate authority should be rejected")
+	}
+	ca, err := ioutil.TempFile("", "ingressify-ca")
+	if err != nil {
+		t.Fatalf("Failed to create CA file: %s", err)
+	}
+	defer os.Remove(ca.Name())
+	pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	ca.Close()
+	if _, err = (&HTTPHook{URL: server.URL, TLS: HTTPTLS{CAFile: ca.Name()}}).Run(HookOptions{}); err != nil {
+		t.Errorf("Trusted certificate authority should be accepted, got: %s", err)
+	}
+	if _, err = (&HTTPHook{URL: server.URL, TLS: HTTPTLS{InsecureSkipVerify: true}}).Run(HookOptions{}); err != nil {
+		t.Errorf("Verification should be skipped, got: %s", err)
+	}
+}
+
+func TestHTTPHookSteps(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer server.Close()
+	var hook Hook
+	err := yaml.Unmarshal([]byte(`
+post_render:
+  - [/bin/true]
+  - http:
+      method: put
+      url: `+server.URL+`
+      body: '{{ len .IngRules }}'
+`), &hook)
+	if err != nil {
+		t.Fatalf("Failed to parse hooks: %s", err)
+	}
+	if err = hook.Prepare(nil); err != nil {
+		t.Fatalf("Failed to prepare hooks: %s", err)
+	}
+	results, err := RunSteps("post_render", hook.PostRender, HookOptions{})
+	if err != nil || calls != 1 || len(results) != 2 || results[1].Command[0] != "PUT "+server.URL {
+		t.Errorf("HTTP step should be run after the command, got: %+v (%v)", results, err)
+	}
+	if err = (Hook{PostRender: HookSteps{{HTTP: &HTTPHook{}}}}).Prepare(nil); err == nil {
+		t.Errorf("HTTP hook without url should be rejected")
+	}
+	if err = yaml.Unmarshal([]byte("validate:\n  - command: [/bin/true]\n    http: {url: 'http://localhost'}\n"), &hook); err == nil {
+		t.Errorf("Step with both a command and an http request should be rejected")
+	}
+}
+
+func TestHTTPHookWithFile(t *testing.T) {
+	var path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		path, body = r.URL.Path, string(data)
+	}))
+	defer server.Close()
+	steps := HookSteps{{HTTP: &HTTPHook{URL: server.URL + "/check{{file}}", Body: `{"config": "{{ file }}"}`}}}
+	if err := (Hook{Validate: steps}).Prepare(nil); err != nil {
+		t.Fatalf("Failed to prepare hooks: %s", err)
+	}
+	if _, err := RunSteps("validate", steps.WithFile("/tmp/haproxy.cfg"), HookOptions{}); err != nil {
+		t.Fatalf("Validate step failed: %s", err)
+	}
+	if expected := `{"config": "/tmp/haproxy.cfg"}`; path != "/check/tmp/haproxy.cfg" || body != expected {
+		t.Errorf("Wrong request, got: %s %s, expected: %s %s", path, body, "/check/tmp/haproxy.cfg", expected)
+	}
+	if _, err := RunSteps("post_render", steps, HookOptions{}); err != nil || body != `{"config": ""}` {
+		t.Errorf("File should be empty outside of validate hooks, got: %s (%v)", body, err)
+	}
+}